@@ -0,0 +1,349 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ktrysmt/go-bitbucket"
+)
+
+// export writes a gzipped tar per repo with
+//
+//	manifest.json      archiveManifest
+//	repo.json          the bitbucket repo
+//	pullrequests.json  its open and merged PRs
+//	comments.json      the comments of those PRs, keyed by PR id
+//	permissions.json   its user and group permissions
+//	repo.bundle        git bundle of every ref, missing when contents aren't migrated or the repo is empty
+//	lfs/objects/...    the LFS objects it references, laid out like git-lfs does
+const archiveVersion = 1
+
+type archiveManifest struct {
+	Version           int       `json:"version"`
+	ExportedAt        time.Time `json:"exportedAt"`
+	Workspace         string    `json:"workspace"`
+	Repo              string    `json:"repo"`
+	MissingLfsObjects []string  `json:"missingLfsObjects"`
+}
+
+func archivePath(dir string, repoName string) string {
+	return filepath.Join(dir, repoName+".tar.gz")
+}
+
+func exportRepos(bb *bitbucketClient, repos []string, dir string, config settings) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		fatalf("Failed to create export directory: %s", err)
+	}
+	for _, repo := range repos {
+		exportRepo(bb, repo, dir, config)
+	}
+}
+
+// runs the bitbucket half of a migration and writes everything the other half needs to an archive
+func exportRepo(bb *bitbucketClient, repoName string, dir string, config settings) {
+	stopLog := startRepoLog(repoName, config)
+	defer stopLog()
+	report.startRepo(repoName)
+
+	// the permissions from before btg revoked them, if it did
+	var permissions permissionSnapshot
+	if !readState(config, repoName, "permissions", &permissions) {
+		permissions.Permissions = getPermissions(bb, config.bbWorkspace, repoName)
+	}
+	snapshot := snapshotRepo(bb, repoName, config)
+	defer os.RemoveAll(snapshot.folder)
+
+	comments := map[int][]PRComment{}
+	if snapshot.prs != nil {
+		report.phase("get PR comments", func() {
+			for _, pr := range snapshot.prs.Values {
+				comments[pr.ID] = getPrComments(bb, config.bbWorkspace, repoName, pr.ID)
+			}
+		})
+	}
+
+	path := archivePath(dir, repoName)
+	if config.exportFormat == "gei" {
+		path = geiArchivePath(dir, repoName)
+	}
+	report.phase("write archive", func() {
+		var err error
+		if config.exportFormat == "gei" {
+			err = writeGeiArchive(path, snapshot, comments, config)
+		} else {
+			manifest := archiveManifest{
+				Version:           archiveVersion,
+				ExportedAt:        time.Now(),
+				Workspace:         config.bbWorkspace,
+				Repo:              repoName,
+				MissingLfsObjects: snapshot.missingLfsObjects,
+			}
+			err = writeArchive(path, manifest, snapshot, comments, permissions.Permissions)
+		}
+		if err != nil {
+			fatalf("Failed to write archive %s: %s", path, err)
+		}
+	})
+	report.finishRepo()
+	slog.Info("done exporting repo", "archive", path)
+}
+
+func writeArchive(path string, manifest archiveManifest, snapshot repoSnapshot, comments map[int][]PRComment, permissions []permissionChange) error {
+	return createArchive(path, func(tw *tar.Writer) error {
+		for _, entry := range []struct {
+			name string
+			v    any
+		}{
+			{"manifest.json", manifest},
+			{"repo.json", snapshot.repo},
+			{"pullrequests.json", snapshot.prs},
+			{"comments.json", comments},
+			{"permissions.json", permissions},
+		} {
+			err := addJSONToArchive(tw, entry.name, entry.v, manifest.ExportedAt)
+			if err != nil {
+				return err
+			}
+		}
+		if snapshot.folder == "" {
+			return nil
+		}
+		return addGitToArchive(tw, snapshot.folder)
+	})
+}
+
+// writes a gzipped tar to a temp file first, so there never is a half written archive at path
+func createArchive(path string, write func(tw *tar.Writer) error) error {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path + ".tmp")
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+
+	err = write(tw)
+	if err != nil {
+		return err
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// adds a bundle of the repo in repoFolder and the LFS objects it references
+func addGitToArchive(tw *tar.Writer, repoFolder string) error {
+	refs, err := listLocalRefs(repoFolder)
+	if err != nil {
+		return err
+	}
+	// git refuses to create empty bundles
+	if len(refs) > 0 {
+		bundle := filepath.Join(repoFolder, "btg.bundle")
+		output, err := runGitLogged(repoFolder, "bundle", "create", bundle, "--all")
+		if err != nil {
+			return fmt.Errorf("failed to create bundle: %s: %s", err, output)
+		}
+		err = addFileToArchive(tw, "repo.bundle", bundle)
+		if err != nil {
+			return err
+		}
+	}
+
+	lfsObjects, err := findLfsObjects(repoFolder)
+	if err != nil {
+		return err
+	}
+	storage := lfsStorage(repoFolder)
+	for oid := range lfsObjects {
+		path := lfsObjectPath(oid)
+		err := addFileToArchive(tw, filepath.ToSlash(filepath.Join("lfs", path)), filepath.Join(storage, path))
+		// objects bitbucket didn't have are listed in the manifest
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func addJSONToArchive(tw *tar.Writer, name string, v any, modTime time.Time) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func addFileToArchive(tw *tar.Writer, name string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	err = tw.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+func importRepos(target migrationTarget, repos []string, dir string, config settings) {
+	if config.dryRun {
+		slog.Info("Dry Run - not actually migrating anything")
+	}
+	for _, repo := range repos {
+		importRepo(target, repo, dir, config)
+	}
+}
+
+// runs the target half of a migration from an archive written by export, without talking to bitbucket
+func importRepo(target migrationTarget, repoName string, dir string, config settings) {
+	stopLog := startRepoLog(repoName, config)
+	defer stopLog()
+	report.startRepo(repoName)
+	stopJournal := startJournal(repoName, config)
+	defer stopJournal()
+
+	workDir := newWorkDir(repoName, config)
+	defer os.RemoveAll(workDir)
+	var snapshot repoSnapshot
+	report.phase("read archive", func() {
+		snapshot = readArchive(archivePath(dir, repoName), workDir)
+	})
+	migrateSnapshot(target, repoName, snapshot, config)
+
+	if config.bbMarkMoved {
+		slog.Info("import can't reach bitbucket, repos aren't marked as moved")
+	}
+	report.finishRepo()
+	slog.Info("done importing repo")
+
+	time.Sleep(GitHubRateLimitSleep)
+}
+
+// unpacks the archive at path into workDir and clones its bundle
+func readArchive(path string, workDir string) repoSnapshot {
+	err := extractArchive(path, workDir)
+	if err != nil {
+		fatalf("Failed to extract archive %s: %s", path, err)
+	}
+
+	var manifest archiveManifest
+	snapshot := repoSnapshot{repo: &bitbucket.Repository{}}
+	for name, v := range map[string]any{
+		"manifest.json":     &manifest,
+		"repo.json":         snapshot.repo,
+		"pullrequests.json": &snapshot.prs,
+	} {
+		data, err := os.ReadFile(filepath.Join(workDir, name))
+		if err == nil {
+			err = json.Unmarshal(data, v)
+		}
+		if err != nil {
+			fatalf("Failed to read %s from archive %s: %s", name, path, err)
+		}
+	}
+	if manifest.Version != archiveVersion {
+		fatalf("Archive %s has version %d, this btg reads version %d", path, manifest.Version, archiveVersion)
+	}
+	slog.Info("Read archive", "archive", path, "exported_at", manifest.ExportedAt)
+	snapshot.missingLfsObjects = manifest.MissingLfsObjects
+
+	bundle := filepath.Join(workDir, "repo.bundle")
+	if _, err := os.Stat(bundle); err != nil {
+		slog.Info("Archive has no repo contents")
+		return snapshot
+	}
+	lfs, err := filepath.Abs(filepath.Join(workDir, "lfs"))
+	if err != nil {
+		fatalf("Failed to find LFS objects of the archive: %s", err)
+	}
+	snapshot.folder = filepath.Join(workDir, "repo.git")
+	for _, args := range [][]string{
+		{"clone", "--mirror", bundle, snapshot.folder},
+		{"-C", snapshot.folder, "config", "lfs.storage", lfs},
+	} {
+		output, err := runGitLogged("", args...)
+		if err != nil {
+			fatalf("Failed to clone bundle: %s\nOutput: %s", err, output)
+		}
+	}
+	return snapshot
+}
+
+func extractArchive(path string, dir string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := filepath.FromSlash(header.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("archive contains path %q outside of it", header.Name)
+		}
+		target := filepath.Join(dir, name)
+		err = os.MkdirAll(filepath.Dir(target), 0o755)
+		if err != nil {
+			return err
+		}
+		out, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
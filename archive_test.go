@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestExportImport(t *testing.T) {
+	bb := newFakeBitbucket(t)
+	gh := newFakeGithub(t)
+	config := fakeSettings(t, bb, gh)
+	seedBitbucketRepo(t, bb, config.bbWorkspace, "repo1")
+	bb.addPrComment(config.bbWorkspace, "repo1", 2, "Reviewer", "looks good", nil)
+	dir := t.TempDir()
+
+	exportRepos(bb.client(), []string{"repo1"}, dir, config)
+
+	if got := bb.permission(config.bbWorkspace, "repo1", "user", "account-1"); got != "read" {
+		t.Errorf("expected export to revoke permissions, got %s", got)
+	}
+	contents := t.TempDir()
+	err := extractArchive(archivePath(dir, "repo1"), contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var comments map[int][]PRComment
+	var permissions []permissionChange
+	for name, v := range map[string]any{"comments.json": &comments, "permissions.json": &permissions} {
+		data, _ := os.ReadFile(filepath.Join(contents, name))
+		err := json.Unmarshal(data, v)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+	}
+	if len(comments[1]) != 0 || len(comments[2]) != 1 || comments[2][0].Content.Raw != "looks good" {
+		t.Errorf("unexpected comments %+v", comments)
+	}
+	// the permissions from before they were revoked
+	if len(permissions) != 3 || permissions[0].From != "write" {
+		t.Errorf("unexpected permissions %+v", permissions)
+	}
+
+	// import runs without bitbucket
+	target := newFakeGithub(t)
+	importConfig := fakeSettings(t, bb, target)
+	importConfig.bbWorkspace = ""
+	importConfig.bbGitURL = "http://127.0.0.1:1"
+	importRepos(target.target(importConfig), []string{"repo1"}, dir, importConfig)
+
+	repo := target.repo("org", "repo1")
+	if repo == nil {
+		t.Fatal("repo was not created on github")
+	}
+	bbRefs, _ := listLocalRefs(filepath.Join(bb.gitDir, config.bbWorkspace, "repo1.git"))
+	ghRefs, _ := listLocalRefs(target.gitRepoDir(repo))
+	if diff := deep.Equal(ghRefs, bbRefs); diff != nil {
+		t.Error(diff)
+	}
+	if len(repo.pulls) != 1 || len(repo.issues) != 1 {
+		t.Errorf("expected 1 PR and 1 issue, got %d and %d", len(repo.pulls), len(repo.issues))
+	}
+}
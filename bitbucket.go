@@ -4,10 +4,11 @@ import (
 	"cmp"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,110 +16,291 @@ import (
 	"github.com/mitchellh/mapstructure"
 )
 
-func getRepo(bb *bitbucket.Client, owner string, repoName string) *bitbucket.Repository {
+func getRepo(bb *bitbucketClient, owner string, repoName string) *bitbucket.Repository {
 	ro := &bitbucket.RepositoryOptions{
 		Owner:    owner,
 		RepoSlug: repoName,
 	}
-	repo, err := bb.Repositories.Repository.Get(ro)
+	repo, err := bb.Repository.Get(ro)
 	if err != nil {
-		log.Fatalf("Failed to get repo from bitbucket: %v", err)
+		fatalf("Failed to get repo from bitbucket: %v", err)
 	}
 	return repo
 }
 
-// clones repo to a temp folder
-func cloneRepo(repo string, config settings) (tempfolderpath string) {
-	tempDir, err := os.MkdirTemp("", fmt.Sprintf("%s-%s-*", config.bbWorkspace, repo))
+func bitbucketCloneURL(repo string, config settings) string {
+	if strings.ToLower(config.cloneVia) == "ssh" {
+		if config.bbURL != "" {
+			return fmt.Sprintf("%s/%s/%s.git", config.bbSSHURL, strings.ToLower(config.bbWorkspace), repo)
+		}
+		return fmt.Sprintf("git@bitbucket.org:%s/%s.git", config.bbWorkspace, repo)
+	}
+	if config.bbURL != "" {
+		// project keys are lowercase in Data Center clone urls
+		return fmt.Sprintf("%s/%s/%s.git", config.bbGitURL, strings.ToLower(config.bbWorkspace), repo)
+	}
+	return fmt.Sprintf("%s/%s/%s.git", config.bbGitURL, config.bbWorkspace, repo)
+}
+
+// makes a work copy of repo to migrate from, backed by its mirror in MIRROR_DIR.
+// The work copy shares objects and LFS storage with the mirror, so only changes since the last run are downloaded,
+// callers remove it once they are done. The branches of prs from forks are fetched too, see fetchForkBranches
+func cloneRepo(repo string, prs []plannedPullRequest, config settings) (workCopy string) {
+	mirror := updateMirror(repo, prs, config)
+	workCopy = newWorkDir(repo, config)
+	lfsStorage, err := filepath.Abs(filepath.Join(mirror, "lfs"))
 	if err != nil {
-		log.Fatalf("Failed to create temp directory: %s", err)
+		fatalf("Failed to find LFS storage of the mirror: %s", err)
 	}
 
-	var cloneURL string
-	if strings.ToLower(config.cloneVia) == "ssh" {
-		cloneURL = fmt.Sprintf("git@bitbucket.org:%s/%s.git", config.bbWorkspace, repo)
-	} else {
-		cloneURL = fmt.Sprintf("https://bitbucket.org/%s/%s.git", config.bbWorkspace, repo)
+	slog.Info("Creating work copy", "dir", workCopy)
+	for _, args := range [][]string{
+		{"clone", "--mirror", "--shared", mirror, workCopy},
+		// LFS objects and anything else not in the mirror still come from bitbucket
+		{"-C", workCopy, "remote", "set-url", "origin", bitbucketCloneURL(repo, config)},
+		{"-C", workCopy, "config", "lfs.storage", lfsStorage},
+	} {
+		output, err := runGitLogged("", args...)
+		if err != nil {
+			fatalf("Failed to create work copy: %s\nOutput: %s", err, output)
+		}
 	}
-	fmt.Printf("Cloning repository %s to %s\n", repo, tempDir)
+	return workCopy
+}
 
-	cmd := exec.Command("git", "clone", "--mirror", cloneURL, tempDir)
-	output, err := cmd.CombinedOutput()
+// creates an empty directory in MIRROR_DIR for a run to work on repo in, callers remove it once they are done.
+// Directories that runs which failed left behind are removed first. Each repo has a directory of its own
+// so that clearing it can't touch the work of a repo whose name starts with the same
+func newWorkDir(repo string, config settings) string {
+	repoDir := filepath.Join(config.mirrorDir, "work", config.bbWorkspace, repo)
+	err := os.RemoveAll(repoDir)
+	if err != nil {
+		fatalf("Failed to remove old work directories: %s", err)
+	}
+	err = os.MkdirAll(repoDir, 0o755)
+	if err != nil {
+		fatalf("Failed to create work directory: %s", err)
+	}
+	dir, err := os.MkdirTemp(repoDir, "")
 	if err != nil {
-		log.Fatalf("Failed to clone repository: %s\nOutput: %s", err, string(output))
+		fatalf("Failed to create work directory: %s", err)
 	}
-	fmt.Println(string(output))
+	return dir
+}
 
-	return tempDir
+// the persistent mirror of a bitbucket repo in MIRROR_DIR
+func mirrorPath(repo string, config settings) string {
+	return filepath.Join(config.mirrorDir, config.bbWorkspace, repo+".git")
 }
 
-func updatePermissionsToReadOnly(bb *bitbucket.Client, owner string, repoName string, dryRun bool) {
-	// number is arbitrary, just want to be nice to their API
-	const apiWaitTime = time.Millisecond * 16
+// brings the mirror of repo up to date with bitbucket, cloning it the first time, and fetches the branches
+// of prs from forks. returns the path of the mirror
+func updateMirror(repo string, prs []plannedPullRequest, config settings) string {
+	dir := mirrorPath(repo, config)
+	env := bitbucketGitEnv(config)
+	err := os.MkdirAll(filepath.Dir(dir), 0o755)
+	if err != nil {
+		fatalf("Failed to create mirror directory: %s", err)
+	}
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		// the size of a new mirror isn't known until it is cloned
+		checkDiskSpace(filepath.Dir(dir), 0, config)
+		slog.Info("Cloning repository to mirror", "dir", dir)
+		output, err := runGitLoggedEnv("", env, "clone", "--mirror", bitbucketCloneURL(repo, config), dir)
+		if err != nil {
+			fatalf("Failed to clone repository: %s\nOutput: %s", err, output)
+		}
+		fetchForkBranches(dir, prs, config)
+		return dir
+	}
+	// room for the work copy in case its history gets rewritten
+	size, err := repoSize(dir)
+	if err != nil {
+		fatalf("Failed to get mirror size: %s", err)
+	}
+	checkDiskSpace(dir, size, config)
+	slog.Info("Fetching into mirror", "dir", dir)
+	// prunes the branches of forks fetched last time too
+	output, err := runGitLoggedEnv(dir, env, "remote", "update", "--prune")
+	if err != nil {
+		fatalf("Failed to fetch repository: %s\nOutput: %s", err, output)
+	}
+	fetchForkBranches(dir, prs, config)
+	return dir
+}
 
+// a change to a single user or group permission on a bitbucket repo
+type permissionChange struct {
+	Kind string `json:"kind"` // user or group
+	ID   string `json:"id"`   // account id for users, slug for groups
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// returns the current permissions of every user and group with access to the repo
+// note this does not include permissions inherited from the project
+func getPermissions(bb *bitbucketClient, owner string, repoName string) []permissionChange {
 	ro := &bitbucket.RepositoryOptions{
 		Owner:    owner,
 		RepoSlug: repoName,
 	}
-	user_perms, err := bb.Repositories.Repository.ListUserPermissions(ro)
+	user_perms, err := bb.Repository.ListUserPermissions(ro)
 	if err != nil {
-		log.Fatalf("Failed to get user permissions: %v", err)
+		fatalf("Failed to get user permissions: %v", err)
 	}
-	group_perms, err := bb.Repositories.Repository.ListGroupPermissions(ro)
+	group_perms, err := bb.Repository.ListGroupPermissions(ro)
 	if err != nil {
-		log.Fatalf("Failed to get group permissions: %v", err)
+		fatalf("Failed to get group permissions: %v", err)
 	}
 
-	if dryRun {
-		return
+	perms := []permissionChange{}
+	for _, userPerm := range user_perms.UserPermissions {
+		perms = append(perms, permissionChange{
+			Kind: "user",
+			ID:   userPerm.User.AccountId,
+			Name: userPerm.User.Username,
+			From: userPerm.Permission,
+			To:   userPerm.Permission,
+		})
+	}
+	for _, groupPerm := range group_perms.GroupPermissions {
+		perms = append(perms, permissionChange{
+			Kind: "group",
+			ID:   groupPerm.Group.Slug,
+			Name: groupPerm.Group.Name,
+			From: groupPerm.Permission,
+			To:   groupPerm.Permission,
+		})
 	}
+	return perms
+}
 
-	for _, userPerm := range user_perms.UserPermissions {
-		user := userPerm.User
-		permOpts := &bitbucket.RepositoryUserPermissionsOptions{
-			Owner:      owner,
-			RepoSlug:   repoName,
-			User:       user.AccountId,
-			Permission: "read",
+// returns the changes needed to make every user and group read only
+func getReadOnlyPermissionChanges(bb *bitbucketClient, owner string, repoName string) []permissionChange {
+	changes := []permissionChange{}
+	for _, perm := range getPermissions(bb, owner, repoName) {
+		if perm.From == "read" {
+			continue
 		}
-		_, err := bb.Repositories.Repository.SetUserPermissions(permOpts)
-		if err != nil {
-			log.Fatalf("Failed to update user permission for %s: %v", user.Username, err)
+		perm.To = "read"
+		changes = append(changes, perm)
+	}
+	return changes
+}
+
+func updatePermissionsToReadOnly(bb *bitbucketClient, repoName string, config settings) {
+	snapshotPermissions(bb, repoName, config)
+	setPermissions(bb, config.bbWorkspace, repoName, getReadOnlyPermissionChanges(bb, config.bbWorkspace, repoName), config.dryRun)
+}
+
+// permissions of a repo before btg changed them, From and To of every permission are the same
+type permissionSnapshot struct {
+	TakenAt     time.Time          `json:"takenAt"`
+	Permissions []permissionChange `json:"permissions"`
+}
+
+// saves the current permissions to STATE_DIR so restore-permissions can put them back.
+// An existing snapshot is kept as it has the permissions from before btg first changed them
+func snapshotPermissions(bb *bitbucketClient, repoName string, config settings) {
+	if config.dryRun {
+		return
+	}
+	if readState(config, repoName, "permissions", &permissionSnapshot{}) {
+		slog.Info("Keeping existing permission snapshot", "file", statePath(config, repoName, "permissions"))
+		return
+	}
+	writeState(config, repoName, "permissions", permissionSnapshot{
+		TakenAt:     time.Now(),
+		Permissions: getPermissions(bb, config.bbWorkspace, repoName),
+	})
+}
+
+// puts every user and group back to the permission it had in the snapshot.
+// Users and groups given access after the snapshot keep it
+func restorePermissions(bb *bitbucketClient, repoName string, config settings) {
+	var snapshot permissionSnapshot
+	if !readState(config, repoName, "permissions", &snapshot) {
+		slog.Info("No permission snapshot to restore", "repo", repoName)
+		return
+	}
+	current := map[string]string{}
+	for _, perm := range getPermissions(bb, config.bbWorkspace, repoName) {
+		current[perm.Kind+":"+perm.ID] = perm.From
+	}
+	changes := []permissionChange{}
+	for _, perm := range snapshot.Permissions {
+		from := current[perm.Kind+":"+perm.ID]
+		if from == perm.From {
+			continue
 		}
-		time.Sleep(apiWaitTime)
+		changes = append(changes, permissionChange{Kind: perm.Kind, ID: perm.ID, Name: perm.Name, From: from, To: perm.From})
 	}
+	slog.Info("Restoring bitbucket permissions", "repo", repoName, "changes", len(changes))
+	setPermissions(bb, config.bbWorkspace, repoName, changes, config.dryRun)
+	if !config.dryRun {
+		removeState(config, repoName, "permissions")
+	}
+}
 
-	for _, groupPerm := range group_perms.GroupPermissions {
-		groupSlug := groupPerm.Group.Slug
-		permOpts := &bitbucket.RepositoryGroupPermissionsOptions{
-			Owner:      owner,
-			RepoSlug:   repoName,
-			Group:      groupSlug,
-			Permission: "read",
+func setPermissions(bb *bitbucketClient, owner string, repoName string, changes []permissionChange, dryRun bool) {
+	// number is arbitrary, just want to be nice to their API
+	const apiWaitTime = time.Millisecond * 16
+
+	if dryRun {
+		return
+	}
+
+	for _, change := range changes {
+		var err error
+		if change.Kind == "user" {
+			permOpts := &bitbucket.RepositoryUserPermissionsOptions{
+				Owner:      owner,
+				RepoSlug:   repoName,
+				User:       change.ID,
+				Permission: change.To,
+			}
+			_, err = bb.Repository.SetUserPermissions(permOpts)
+		} else {
+			permOpts := &bitbucket.RepositoryGroupPermissionsOptions{
+				Owner:      owner,
+				RepoSlug:   repoName,
+				Group:      change.ID,
+				Permission: change.To,
+			}
+			_, err = bb.Repository.SetGroupPermissions(permOpts)
 		}
-		_, err := bb.Repositories.Repository.SetGroupPermissions(permOpts)
 		if err != nil {
-			log.Fatalf("Failed to update group permission for %s: %v", groupSlug, err)
+			fatalf("Failed to update %s permission for %s: %v", change.Kind, change.Name, err)
 		}
 		time.Sleep(apiWaitTime)
 	}
 }
 
-func getPrs(bb *bitbucket.Client, owner string, repo string, destinationBranch string) *PullRequests {
+func getPrs(bb *bitbucketClient, owner string, repo string, destinationBranch string) *PullRequests {
+	return getPrsInStates(bb, owner, repo, destinationBranch, "MERGED", "OPEN")
+}
+
+// like getPrs, for the PRs in any of states
+func getPrsInStates(bb *bitbucketClient, owner string, repo string, destinationBranch string, states ...string) *PullRequests {
+	quoted := []string{}
+	for _, state := range states {
+		quoted = append(quoted, strconv.Quote(state))
+	}
 	opt := &bitbucket.PullRequestsOptions{
 		Owner:             owner,
 		RepoSlug:          repo,
 		DestinationBranch: destinationBranch,
-		Query:             "state IN (\"MERGED\", \"OPEN\")",
+		Query:             fmt.Sprintf("state IN (%s)", strings.Join(quoted, ", ")),
 	}
-	fmt.Println("getting prs for", repo)
-	response, err := bb.Repositories.PullRequests.Gets(opt)
+	slog.Info("Getting PRs")
+	response, err := bb.PullRequests.Gets(opt)
 	if err != nil {
-		log.Fatalf("Failed to get PRs: %v", err)
+		fatalf("Failed to get PRs: %v", err)
 	}
 	prs, err := decodePullRequests(response)
 	if err != nil {
-		log.Fatalf("Error decoding PRs: %v", err)
+		fatalf("Error decoding PRs: %v", err)
 	}
 	slices.SortFunc(prs.Values, func(i PullRequest, j PullRequest) int {
 		return cmp.Compare(i.ID, j.ID)
@@ -175,6 +357,13 @@ type PullRequest struct {
 	Queued            bool
 }
 
+// the commit hash of the source or destination of a PR, "" when bitbucket didn't return one
+func prCommitHash(side map[string]any) string {
+	commit, _ := side["commit"].(map[string]any)
+	hash, _ := commit["hash"].(string)
+	return hash
+}
+
 type PRRendered struct {
 	Title       PRText
 	Description PRText
@@ -260,3 +449,46 @@ func decodePullRequest(response interface{}) (*PullRequest, error) {
 
 	return pr, nil
 }
+
+type PRComment struct {
+	ID        int
+	Content   PRText
+	User      map[string]any
+	Inline    map[string]any
+	Parent    map[string]any
+	Deleted   bool
+	CreatedOn time.Time `mapstructure:"created_on"`
+	UpdatedOn time.Time `mapstructure:"updated_on"`
+}
+
+func getPrComments(bb *bitbucketClient, owner string, repo string, prID int) []PRComment {
+	opt := &bitbucket.PullRequestsOptions{
+		Owner:    owner,
+		RepoSlug: repo,
+		ID:       strconv.Itoa(prID),
+	}
+	response, err := bb.PullRequests.GetComments(opt)
+	if err != nil {
+		fatalf("Failed to get comments of PR %d: %v", prID, err)
+	}
+	responseMap, ok := response.(map[string]interface{})
+	if !ok {
+		fatalf("Error decoding comments of PR %d: not a valid format", prID)
+	}
+	comments := []PRComment{}
+	for _, entry := range responseMap["values"].([]interface{}) {
+		var comment PRComment
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			Result:     &comment,
+			DecodeHook: stringToTimeHookFunc,
+		})
+		if err == nil {
+			err = decoder.Decode(entry)
+		}
+		if err != nil {
+			fatalf("Error decoding comments of PR %d: %v", prID, err)
+		}
+		comments = append(comments, comment)
+	}
+	return comments
+}
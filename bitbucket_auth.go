@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// how btg authenticates to bitbucket, selected with BITBUCKET_AUTH
+const (
+	// username and app password (or Data Center password)
+	bitbucketAuthBasic = "basic"
+	// workspace, project or repository access token (or Data Center HTTP access token)
+	bitbucketAuthToken = "token"
+	// OAuth consumer using the client credentials grant
+	bitbucketAuthOAuth = "oauth"
+)
+
+const bitbucketOAuthTokenURL = "https://bitbucket.org/site/oauth2/access_token"
+
+// bitbucket accepts access tokens over git https with this username
+const bitbucketTokenUsername = "x-token-auth"
+
+// returns access tokens of an OAuth consumer, fetching a new one when the current one expires
+func newBitbucketOAuth(config settings) oauth2.TokenSource {
+	conf := &clientcredentials.Config{
+		ClientID:     config.bbOAuthClientID,
+		ClientSecret: config.bbOAuthClientSecret,
+		TokenURL:     config.bbOAuthTokenURL,
+	}
+	return conf.TokenSource(context.Background())
+}
+
+// the username and password git uses for bitbucket over https
+func bitbucketGitCredentials(config settings) (string, string) {
+	switch config.bbAuth {
+	case bitbucketAuthToken:
+		// personal access tokens on Data Center need the username of their owner
+		if config.bbUsername != "" {
+			return config.bbUsername, config.bbPassword
+		}
+		return bitbucketTokenUsername, config.bbPassword
+	case bitbucketAuthOAuth:
+		token, err := config.bbTokens.Token()
+		if err != nil {
+			fatalf("Failed to get Bitbucket OAuth token: %s", err)
+		}
+		return bitbucketTokenUsername, token.AccessToken
+	}
+	return config.bbUsername, config.bbPassword
+}
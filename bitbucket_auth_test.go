@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ktrysmt/go-bitbucket"
+)
+
+func TestBitbucketOAuth(t *testing.T) {
+	tokensIssued := 0
+	// the first token is about to expire so it has to be refreshed right away
+	expiries := []int{1, 3600}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /site/oauth2/access_token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "client" || secret != "secret" || r.FormValue("grant_type") != "client_credentials" {
+			http.Error(w, "bad client", http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"access_token": fmt.Sprintf("token-%d", tokensIssued),
+			"token_type":   "bearer",
+			"expires_in":   expiries[tokensIssued],
+		})
+		tokensIssued++
+	})
+	mux.HandleFunc("GET /repositories/workspace/repo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-1" {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"type": "repository", "slug": "repo", "full_name": "workspace/repo"})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	t.Setenv("BITBUCKET_API_BASE_URL", server.URL)
+
+	config := settings{
+		bbAuth:              bitbucketAuthOAuth,
+		bbOAuthClientID:     "client",
+		bbOAuthClientSecret: "secret",
+		bbOAuthTokenURL:     server.URL + "/site/oauth2/access_token",
+	}
+	config.bbTokens = newBitbucketOAuth(config)
+
+	for _, want := range []string{"token-0", "token-1"} {
+		username, password := bitbucketGitCredentials(config)
+		if username != bitbucketTokenUsername || password != want {
+			t.Errorf("expected %s:%s, got %s:%s", bitbucketTokenUsername, want, username, password)
+		}
+	}
+
+	bb := newSourceClient(config)
+	repo, err := bb.Repository.Get(&bitbucket.RepositoryOptions{Owner: "workspace", RepoSlug: "repo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.Slug != "repo" {
+		t.Errorf("expected repo, got %s", repo.Slug)
+	}
+}
+
+func TestBitbucketGitCredentials(t *testing.T) {
+	tests := []struct {
+		config   settings
+		username string
+	}{
+		{settings{bbAuth: bitbucketAuthBasic, bbUsername: "user", bbPassword: "secret"}, "user"},
+		{settings{bbAuth: bitbucketAuthToken, bbPassword: "secret"}, bitbucketTokenUsername},
+		{settings{bbAuth: bitbucketAuthToken, bbUsername: "user", bbPassword: "secret"}, "user"},
+	}
+	for _, test := range tests {
+		username, password := bitbucketGitCredentials(test.config)
+		if username != test.username || password != "secret" {
+			t.Errorf("%s: expected %s:secret, got %s:%s", test.config.bbAuth, test.username, username, password)
+		}
+	}
+}
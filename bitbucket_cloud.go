@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// talks to the Bitbucket Cloud 2.0 API directly for the few calls go-bitbucket doesn't cover
+type cloudAPI struct {
+	baseURL   string
+	client    *http.Client
+	authorize func(req *http.Request)
+}
+
+func (api *cloudAPI) request(method string, path string, contentType string, body io.Reader, result any) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(api.baseURL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if api.authorize != nil {
+		api.authorize(req)
+	}
+	resp, err := api.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var cloudErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(respBody, &cloudErr)
+		return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, cloudErr.Error.Message)
+	}
+	if result == nil || len(bytes.TrimSpace(respBody)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, result)
+}
+
+func (api *cloudAPI) requestJSON(method string, path string, body any, result any) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return api.request(method, path, "application/json", bytes.NewReader(encoded), result)
+}
+
+func cloudRepoPath(workspace string, slug string) string {
+	return fmt.Sprintf("/repositories/%s/%s", url.PathEscape(workspace), url.PathEscape(slug))
+}
+
+func (api *cloudAPI) UpdateSettings(owner string, repoSlug string, settings bitbucketRepoSettings) error {
+	body := map[string]any{"description": settings.Description}
+	if settings.HasIssues != nil {
+		body["has_issues"] = *settings.HasIssues
+	}
+	if settings.HasWiki != nil {
+		body["has_wiki"] = *settings.HasWiki
+	}
+	return api.requestJSON("PUT", cloudRepoPath(owner, repoSlug), body, nil)
+}
+
+// the src endpoint takes files as form fields named after their path
+func (api *cloudAPI) commit(owner string, repoSlug string, fields map[string]string) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		err := form.WriteField(name, value)
+		if err != nil {
+			return err
+		}
+	}
+	err := form.Close()
+	if err != nil {
+		return err
+	}
+	return api.request("POST", cloudRepoPath(owner, repoSlug)+"/src", form.FormDataContentType(), &body, nil)
+}
+
+func (api *cloudAPI) WriteFile(owner string, repoSlug string, branch string, path string, content []byte, message string) error {
+	return api.commit(owner, repoSlug, map[string]string{path: string(content), "branch": branch, "message": message})
+}
+
+func (api *cloudAPI) DeleteFile(owner string, repoSlug string, branch string, path string, message string) error {
+	return api.commit(owner, repoSlug, map[string]string{"files": path, "branch": branch, "message": message})
+}
+
+// restrictions that list no users or groups apply to everyone, admins included
+func (api *cloudAPI) Freeze(owner string, repoSlug string) ([]string, error) {
+	ids := []string{}
+	for _, kind := range []string{"push", "restrict_merges"} {
+		var restriction struct {
+			ID int `json:"id"`
+		}
+		err := api.requestJSON("POST", cloudRepoPath(owner, repoSlug)+"/branch-restrictions", map[string]any{
+			"kind":              kind,
+			"branch_match_kind": "glob",
+			"pattern":           "*",
+			"users":             []any{},
+			"groups":            []any{},
+		}, &restriction)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, strconv.Itoa(restriction.ID))
+	}
+	return ids, nil
+}
+
+func (api *cloudAPI) Unfreeze(owner string, repoSlug string, id string) error {
+	return api.request("DELETE", cloudRepoPath(owner, repoSlug)+"/branch-restrictions/"+url.PathEscape(id), "", nil, nil)
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ktrysmt/go-bitbucket"
+)
+
+// talks to the REST 1.0 API of Bitbucket Data Center (or Server).
+// it implements the same interfaces as the Bitbucket Cloud client by converting
+// Data Center responses to their Cloud equivalent, so the rest of btg doesn't need to know the difference.
+// The workspace is the project key on Data Center
+type dataCenterAPI struct {
+	baseURL  string
+	username string
+	token    string
+	client   *http.Client
+}
+
+func newDataCenterClient(baseURL string, username string, token string) *bitbucketClient {
+	api := &dataCenterAPI{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		username: username,
+		token:    token,
+		client:   http.DefaultClient,
+	}
+	return &bitbucketClient{
+		Repository:   &dataCenterRepository{api},
+		PullRequests: &dataCenterPullRequests{api},
+		Settings:     &dataCenterSettings{api},
+	}
+}
+
+func (api *dataCenterAPI) do(method string, path string, query url.Values, result any) error {
+	return api.request(method, "/rest/api/1.0"+path, query, "", nil, result)
+}
+
+func (api *dataCenterAPI) doJSON(method string, path string, body any, result any) error {
+	return api.requestJSON(method, "/rest/api/1.0"+path, body, result)
+}
+
+func (api *dataCenterAPI) requestJSON(method string, path string, body any, result any) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return api.request(method, path, nil, "application/json", bytes.NewReader(encoded), result)
+}
+
+func (api *dataCenterAPI) request(method string, path string, query url.Values, contentType string, body io.Reader, result any) error {
+	reqURL := api.baseURL + path
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, reqURL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	// Data Center rejects form uploads without this header as possible XSRF
+	req.Header.Set("X-Atlassian-Token", "no-check")
+	if api.username == "" {
+		// HTTP access tokens can be used without a username
+		req.Header.Set("Authorization", "Bearer "+api.token)
+	} else {
+		req.SetBasicAuth(api.username, api.token)
+	}
+	resp, err := api.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var dcErr struct {
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		}
+		json.Unmarshal(respBody, &dcErr)
+		if len(dcErr.Errors) > 0 {
+			return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, dcErr.Errors[0].Message)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if result == nil || len(bytes.TrimSpace(respBody)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, result)
+}
+
+// follows the start/limit paging of Data Center and returns every value
+func (api *dataCenterAPI) getPaged(path string, query url.Values) ([]json.RawMessage, error) {
+	values := []json.RawMessage{}
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("limit", "100")
+	start := 0
+	for {
+		query.Set("start", strconv.Itoa(start))
+		var page struct {
+			Values        []json.RawMessage `json:"values"`
+			IsLastPage    bool              `json:"isLastPage"`
+			NextPageStart int               `json:"nextPageStart"`
+		}
+		err := api.do("GET", path, query, &page)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, page.Values...)
+		if page.IsLastPage || len(page.Values) == 0 {
+			return values, nil
+		}
+		start = page.NextPageStart
+	}
+}
+
+func repoPath(projectKey string, slug string) string {
+	return fmt.Sprintf("/projects/%s/repos/%s", url.PathEscape(projectKey), url.PathEscape(slug))
+}
+
+// Data Center has REPO_READ, REPO_WRITE and REPO_ADMIN where Cloud has read, write and admin
+func cloudPermission(dcPermission string) string {
+	return strings.ToLower(strings.TrimPrefix(dcPermission, "REPO_"))
+}
+
+func dataCenterPermission(cloudPermission string) string {
+	return "REPO_" + strings.ToUpper(cloudPermission)
+}
+
+type dataCenterRepository struct {
+	api *dataCenterAPI
+}
+
+func (r *dataCenterRepository) Get(ro *bitbucket.RepositoryOptions) (*bitbucket.Repository, error) {
+	var repo struct {
+		Slug        string `json:"slug"`
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Public      bool   `json:"public"`
+		Project     struct {
+			Key    string `json:"key"`
+			Name   string `json:"name"`
+			Public bool   `json:"public"`
+		} `json:"project"`
+	}
+	err := r.api.do("GET", repoPath(ro.Owner, ro.RepoSlug), nil, &repo)
+	if err != nil {
+		return nil, err
+	}
+	var defaultBranch struct {
+		DisplayID string `json:"displayId"`
+	}
+	err = r.api.do("GET", repoPath(ro.Owner, ro.RepoSlug)+"/default-branch", nil, &defaultBranch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get default branch: %w", err)
+	}
+	return &bitbucket.Repository{
+		Slug:        repo.Slug,
+		Name:        repo.Name,
+		Full_name:   repo.Project.Key + "/" + repo.Slug,
+		Description: repo.Description,
+		// Data Center doesn't track the language of a repo
+		Is_private: !repo.Public && !repo.Project.Public,
+		Mainbranch: bitbucket.RepositoryBranch{Type: "branch", Name: defaultBranch.DisplayID},
+		Project: bitbucket.Project{
+			Key:  repo.Project.Key,
+			Name: repo.Project.Name,
+		},
+	}, nil
+}
+
+func (r *dataCenterRepository) ListUserPermissions(ro *bitbucket.RepositoryOptions) (*bitbucket.UserPermissions, error) {
+	values, err := r.api.getPaged(repoPath(ro.Owner, ro.RepoSlug)+"/permissions/users", nil)
+	if err != nil {
+		return nil, err
+	}
+	perms := &bitbucket.UserPermissions{}
+	for _, value := range values {
+		var perm struct {
+			User struct {
+				Name        string `json:"name"`
+				DisplayName string `json:"displayName"`
+			} `json:"user"`
+			Permission string `json:"permission"`
+		}
+		err := json.Unmarshal(value, &perm)
+		if err != nil {
+			return nil, err
+		}
+		perms.UserPermissions = append(perms.UserPermissions, bitbucket.UserPermission{
+			Type: "repository_user_permission",
+			// the user name is what identifies a user when changing permissions
+			User: bitbucket.User{
+				AccountId:   perm.User.Name,
+				Username:    perm.User.Name,
+				DisplayName: perm.User.DisplayName,
+			},
+			Permission: cloudPermission(perm.Permission),
+		})
+	}
+	perms.Size = len(perms.UserPermissions)
+	return perms, nil
+}
+
+func (r *dataCenterRepository) ListGroupPermissions(ro *bitbucket.RepositoryOptions) (*bitbucket.GroupPermissions, error) {
+	values, err := r.api.getPaged(repoPath(ro.Owner, ro.RepoSlug)+"/permissions/groups", nil)
+	if err != nil {
+		return nil, err
+	}
+	perms := &bitbucket.GroupPermissions{}
+	for _, value := range values {
+		var perm struct {
+			Group struct {
+				Name string `json:"name"`
+			} `json:"group"`
+			Permission string `json:"permission"`
+		}
+		err := json.Unmarshal(value, &perm)
+		if err != nil {
+			return nil, err
+		}
+		perms.GroupPermissions = append(perms.GroupPermissions, bitbucket.GroupPermission{
+			Type:       "repository_group_permission",
+			Group:      bitbucket.Group{Slug: perm.Group.Name, Name: perm.Group.Name},
+			Permission: cloudPermission(perm.Permission),
+		})
+	}
+	perms.Size = len(perms.GroupPermissions)
+	return perms, nil
+}
+
+func (r *dataCenterRepository) SetUserPermissions(rgo *bitbucket.RepositoryUserPermissionsOptions) (*bitbucket.UserPermission, error) {
+	query := url.Values{"name": {rgo.User}, "permission": {dataCenterPermission(rgo.Permission)}}
+	err := r.api.do("PUT", repoPath(rgo.Owner, rgo.RepoSlug)+"/permissions/users", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &bitbucket.UserPermission{
+		User:       bitbucket.User{AccountId: rgo.User, Username: rgo.User},
+		Permission: rgo.Permission,
+	}, nil
+}
+
+func (r *dataCenterRepository) SetGroupPermissions(rgo *bitbucket.RepositoryGroupPermissionsOptions) (*bitbucket.GroupPermission, error) {
+	query := url.Values{"name": {rgo.Group}, "permission": {dataCenterPermission(rgo.Permission)}}
+	err := r.api.do("PUT", repoPath(rgo.Owner, rgo.RepoSlug)+"/permissions/groups", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &bitbucket.GroupPermission{
+		Group:      bitbucket.Group{Slug: rgo.Group, Name: rgo.Group},
+		Permission: rgo.Permission,
+	}, nil
+}
+
+type dataCenterSettings struct {
+	api *dataCenterAPI
+}
+
+// Data Center repos have no issues or wiki, so only the description is updated
+func (s *dataCenterSettings) UpdateSettings(owner string, repoSlug string, settings bitbucketRepoSettings) error {
+	return s.api.doJSON("PUT", repoPath(owner, repoSlug), map[string]any{"description": settings.Description}, nil)
+}
+
+func (s *dataCenterSettings) WriteFile(owner string, repoSlug string, branch string, path string, content []byte, message string) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("content", string(content))
+	form.WriteField("branch", branch)
+	form.WriteField("message", message)
+	err := form.Close()
+	if err != nil {
+		return err
+	}
+	return s.api.request("PUT", "/rest/api/1.0"+repoPath(owner, repoSlug)+"/browse/"+path, nil, form.FormDataContentType(), &body, nil)
+}
+
+func (s *dataCenterSettings) DeleteFile(owner string, repoSlug string, branch string, path string, message string) error {
+	return errors.New("Bitbucket Data Center can't delete files through its API")
+}
+
+// a read-only restriction on every ref stops pushes and merges, without exceptions it applies to everyone
+func (s *dataCenterSettings) Freeze(owner string, repoSlug string) ([]string, error) {
+	var restriction struct {
+		ID int `json:"id"`
+	}
+	err := s.api.requestJSON("POST", "/rest/branch-permissions/2.0"+repoPath(owner, repoSlug)+"/restrictions", map[string]any{
+		"type": "read-only",
+		"matcher": map[string]any{
+			"id":        "*",
+			"displayId": "*",
+			"type":      map[string]any{"id": "PATTERN", "name": "Pattern"},
+			"active":    true,
+		},
+		"users":      []any{},
+		"groups":     []any{},
+		"accessKeys": []any{},
+	}, &restriction)
+	if err != nil {
+		return nil, err
+	}
+	return []string{strconv.Itoa(restriction.ID)}, nil
+}
+
+func (s *dataCenterSettings) Unfreeze(owner string, repoSlug string, id string) error {
+	return s.api.request("DELETE", "/rest/branch-permissions/2.0"+repoPath(owner, repoSlug)+"/restrictions/"+url.PathEscape(id), nil, "", nil, nil)
+}
+
+type dataCenterPullRequests struct {
+	api *dataCenterAPI
+}
+
+type dataCenterRef struct {
+	ID           string `json:"id"`
+	DisplayID    string `json:"displayId"`
+	LatestCommit string `json:"latestCommit"`
+	Repository   struct {
+		Slug    string `json:"slug"`
+		Project struct {
+			Key string `json:"key"`
+		} `json:"project"`
+	} `json:"repository"`
+}
+
+type dataCenterUser struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type dataCenterPullRequest struct {
+	ID          int    `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	State       string `json:"state"`
+	Draft       bool   `json:"draft"`
+	CreatedDate int64  `json:"createdDate"`
+	UpdatedDate int64  `json:"updatedDate"`
+	Author      struct {
+		User dataCenterUser `json:"user"`
+	} `json:"author"`
+	FromRef    dataCenterRef `json:"fromRef"`
+	ToRef      dataCenterRef `json:"toRef"`
+	Properties struct {
+		CommentCount int `json:"commentCount"`
+		MergeCommit  struct {
+			ID string `json:"id"`
+		} `json:"mergeCommit"`
+	} `json:"properties"`
+}
+
+// returns the PRs of the repo in the states po.Query asks for in the shape of a Bitbucket Cloud response
+// so that decodePullRequests can handle it. PRs into other branches than po.DestinationBranch are skipped
+// when it is set
+func (p *dataCenterPullRequests) Gets(po *bitbucket.PullRequestsOptions) (interface{}, error) {
+	path := repoPath(po.Owner, po.RepoSlug) + "/pull-requests"
+	query := url.Values{"state": {"ALL"}, "order": {"OLDEST"}}
+	if po.DestinationBranch != "" {
+		query.Set("at", "refs/heads/"+po.DestinationBranch)
+	}
+	values, err := p.api.getPaged(path, query)
+	if err != nil {
+		return nil, err
+	}
+	prs := []interface{}{}
+	for _, value := range values {
+		var pr dataCenterPullRequest
+		err := json.Unmarshal(value, &pr)
+		if err != nil {
+			return nil, err
+		}
+		// btg's queries only ever filter on the state
+		if !strings.Contains(po.Query, strconv.Quote(pr.State)) {
+			continue
+		}
+		if po.DestinationBranch != "" && pr.ToRef.DisplayID != po.DestinationBranch {
+			continue
+		}
+		cloudPr := map[string]interface{}{
+			"type":          "pullrequest",
+			"id":            pr.ID,
+			"title":         pr.Title,
+			"state":         pr.State,
+			"draft":         pr.Draft,
+			"summary":       map[string]interface{}{"raw": pr.Description, "markup": "markdown"},
+			"author":        map[string]interface{}{"display_name": pr.Author.User.DisplayName, "nickname": pr.Author.User.Name},
+			"source":        cloudRef(pr.FromRef),
+			"destination":   cloudRef(pr.ToRef),
+			"comment_count": pr.Properties.CommentCount,
+			"created_on":    cloudTime(pr.CreatedDate),
+			"updated_on":    cloudTime(pr.UpdatedDate),
+		}
+		if pr.State == "MERGED" {
+			mergedBy, err := p.mergedBy(path, pr.ID)
+			if err != nil {
+				return nil, err
+			}
+			cloudPr["merge_commit"] = map[string]interface{}{"hash": pr.Properties.MergeCommit.ID}
+			cloudPr["closed_by"] = map[string]interface{}{"display_name": mergedBy}
+		}
+		prs = append(prs, cloudPr)
+	}
+	return map[string]interface{}{
+		"page":    float64(1),
+		"pagelen": float64(len(prs)),
+		"size":    float64(len(prs)),
+		"values":  prs,
+	}, nil
+}
+
+// Data Center only records who merged a PR in its activity
+func (p *dataCenterPullRequests) mergedBy(path string, prID int) (string, error) {
+	activities, err := p.api.getPaged(fmt.Sprintf("%s/%d/activities", path, prID), nil)
+	if err != nil {
+		return "", err
+	}
+	for _, value := range activities {
+		var activity struct {
+			Action string         `json:"action"`
+			User   dataCenterUser `json:"user"`
+		}
+		err := json.Unmarshal(value, &activity)
+		if err != nil {
+			return "", err
+		}
+		if activity.Action == "MERGED" {
+			return activity.User.DisplayName, nil
+		}
+	}
+	return "unknown", nil
+}
+
+type dataCenterComment struct {
+	ID          int                 `json:"id"`
+	Text        string              `json:"text"`
+	Author      dataCenterUser      `json:"author"`
+	CreatedDate int64               `json:"createdDate"`
+	UpdatedDate int64               `json:"updatedDate"`
+	Comments    []dataCenterComment `json:"comments"`
+}
+
+// returns the comments of a PR in the shape of a Bitbucket Cloud response.
+// Data Center nests replies in their parent comment, they are flattened with a parent like Cloud has
+func (p *dataCenterPullRequests) GetComments(po *bitbucket.PullRequestsOptions) (interface{}, error) {
+	path := repoPath(po.Owner, po.RepoSlug) + "/pull-requests/" + po.ID + "/activities"
+	activities, err := p.api.getPaged(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	comments := []interface{}{}
+	var add func(comment dataCenterComment, inline map[string]interface{}, parent int)
+	add = func(comment dataCenterComment, inline map[string]interface{}, parent int) {
+		cloudComment := map[string]interface{}{
+			"type":       "pullrequest_comment",
+			"id":         comment.ID,
+			"content":    map[string]interface{}{"raw": comment.Text, "markup": "markdown"},
+			"user":       map[string]interface{}{"display_name": comment.Author.DisplayName, "nickname": comment.Author.Name},
+			"created_on": cloudTime(comment.CreatedDate),
+			"updated_on": cloudTime(comment.UpdatedDate),
+		}
+		if inline != nil {
+			cloudComment["inline"] = inline
+		}
+		if parent != 0 {
+			cloudComment["parent"] = map[string]interface{}{"id": parent}
+		}
+		comments = append(comments, cloudComment)
+		for _, reply := range comment.Comments {
+			add(reply, inline, comment.ID)
+		}
+	}
+	// activities are newest first
+	for _, value := range slices.Backward(activities) {
+		var activity struct {
+			Action        string            `json:"action"`
+			Comment       dataCenterComment `json:"comment"`
+			CommentAnchor *struct {
+				Path string `json:"path"`
+				Line int    `json:"line"`
+			} `json:"commentAnchor"`
+		}
+		err := json.Unmarshal(value, &activity)
+		if err != nil {
+			return nil, err
+		}
+		if activity.Action != "COMMENTED" {
+			continue
+		}
+		var inline map[string]interface{}
+		if activity.CommentAnchor != nil {
+			inline = map[string]interface{}{"path": activity.CommentAnchor.Path, "to": activity.CommentAnchor.Line}
+		}
+		add(activity.Comment, inline, 0)
+	}
+	return map[string]interface{}{"values": comments}, nil
+}
+
+func cloudRef(ref dataCenterRef) map[string]interface{} {
+	return map[string]interface{}{
+		"branch": map[string]interface{}{"name": ref.DisplayID},
+		"commit": map[string]interface{}{"hash": ref.LatestCommit},
+		"repository": map[string]interface{}{
+			"full_name": ref.Repository.Project.Key + "/" + ref.Repository.Slug,
+		},
+	}
+}
+
+// Data Center uses milliseconds since the epoch, decodePullRequests expects Cloud's timestamp format
+func cloudTime(millis int64) string {
+	return time.UnixMilli(millis).UTC().Format("2006-01-02T15:04:05.000000+00:00")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+// serves a Data Center repo with two pages of PRs, returns its user permissions and ref restrictions by id
+func newFakeDataCenter(t *testing.T) (*httptest.Server, map[string]string, map[string]string) {
+	userPerms := map[string]string{"alice": "REPO_WRITE", "bob": "REPO_READ"}
+	restrictions := map[string]string{}
+	page := func(w http.ResponseWriter, r *http.Request, values []map[string]any) {
+		start := r.URL.Query().Get("start")
+		// one value per page to exercise paging
+		if start == "" || start == "0" {
+			writeJSON(w, http.StatusOK, map[string]any{"values": values[:1], "isLastPage": len(values) == 1, "nextPageStart": 1})
+		} else {
+			writeJSON(w, http.StatusOK, map[string]any{"values": values[1:], "isLastPage": true})
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /rest/api/1.0/projects/PRJ/repos/repo1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"slug": "repo1", "name": "Repo 1", "description": "on prem", "public": false,
+			"project": map[string]any{"key": "PRJ", "name": "Platform Team"},
+		})
+	})
+	mux.HandleFunc("GET /rest/api/1.0/projects/PRJ/repos/repo1/default-branch", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"id": "refs/heads/develop", "displayId": "develop"})
+	})
+	mux.HandleFunc("GET /rest/api/1.0/projects/PRJ/repos/repo1/permissions/users", func(w http.ResponseWriter, r *http.Request) {
+		values := []map[string]any{}
+		for _, name := range []string{"alice", "bob"} {
+			values = append(values, map[string]any{"user": map[string]any{"name": name, "displayName": strings.ToUpper(name)}, "permission": userPerms[name]})
+		}
+		page(w, r, values)
+	})
+	mux.HandleFunc("PUT /rest/api/1.0/projects/PRJ/repos/repo1/permissions/users", func(w http.ResponseWriter, r *http.Request) {
+		userPerms[r.URL.Query().Get("name")] = r.URL.Query().Get("permission")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /rest/api/1.0/projects/PRJ/repos/repo1/permissions/groups", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"isLastPage": true, "values": []map[string]any{}})
+	})
+	mux.HandleFunc("GET /rest/api/1.0/projects/PRJ/repos/repo1/pull-requests", func(w http.ResponseWriter, r *http.Request) {
+		ref := func(branch string) map[string]any {
+			return map[string]any{"id": "refs/heads/" + branch, "displayId": branch, "latestCommit": "abc", "repository": map[string]any{"slug": "repo1", "project": map[string]any{"key": "PRJ"}}}
+		}
+		created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).UnixMilli()
+		values := []map[string]any{}
+		for _, pr := range []map[string]any{
+			{"id": 1, "title": "Merged", "state": "MERGED", "description": "merged work", "createdDate": created, "updatedDate": created,
+				"author": map[string]any{"user": map[string]any{"displayName": "Alice"}}, "fromRef": ref("done"), "toRef": ref("develop"),
+				"properties": map[string]any{"mergeCommit": map[string]any{"id": "def"}}},
+			{"id": 2, "title": "Declined", "state": "DECLINED", "createdDate": created, "updatedDate": created,
+				"author": map[string]any{"user": map[string]any{"displayName": "Bob"}}, "fromRef": ref("nope"), "toRef": ref("develop")},
+			{"id": 3, "title": "Into release", "state": "OPEN", "createdDate": created, "updatedDate": created,
+				"author": map[string]any{"user": map[string]any{"displayName": "Bob"}}, "fromRef": ref("hotfix"), "toRef": ref("release")},
+		} {
+			// like Data Center, only PRs into the branch given with at are returned
+			if at := r.URL.Query().Get("at"); at == "" || pr["toRef"].(map[string]any)["id"] == at {
+				values = append(values, pr)
+			}
+		}
+		page(w, r, values)
+	})
+	mux.HandleFunc("GET /rest/api/1.0/projects/PRJ/repos/repo1/pull-requests/1/activities", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"isLastPage": true, "values": []map[string]any{
+			{"action": "MERGED", "user": map[string]any{"displayName": "Carol"}},
+			{"action": "COMMENTED", "commentAnchor": map[string]any{"path": "main.go", "line": 3}, "comment": map[string]any{
+				"id": 11, "text": "why?", "author": map[string]any{"displayName": "Carol"}, "createdDate": 1704164645000,
+				"comments": []map[string]any{{"id": 12, "text": "because", "author": map[string]any{"displayName": "Alice"}, "createdDate": 1704164645000}},
+			}},
+			{"action": "OPENED", "user": map[string]any{"displayName": "Alice"}},
+		}})
+	})
+	mux.HandleFunc("POST /rest/branch-permissions/2.0/projects/PRJ/repos/repo1/restrictions", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Type    string `json:"type"`
+			Matcher struct {
+				ID string `json:"id"`
+			} `json:"matcher"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		restrictions["1"] = body.Type + " " + body.Matcher.ID
+		writeJSON(w, http.StatusOK, map[string]any{"id": 1, "type": body.Type})
+	})
+	mux.HandleFunc("DELETE /rest/branch-permissions/2.0/projects/PRJ/repos/repo1/restrictions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		delete(restrictions, r.PathValue("id"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, userPerms, restrictions
+}
+
+func TestDataCenterSource(t *testing.T) {
+	server, userPerms, restrictions := newFakeDataCenter(t)
+	bb := newDataCenterClient(server.URL+"/", "user", "token")
+
+	repo := getRepo(bb, "PRJ", "repo1")
+	if repo.Mainbranch.Name != "develop" || !repo.Is_private || repo.Project.Name != "Platform Team" {
+		t.Errorf("unexpected repo %+v", repo)
+	}
+
+	config := settings{bbWorkspace: "PRJ", stateDir: t.TempDir()}
+	updatePermissionsToReadOnly(bb, "repo1", config)
+	if diff := deep.Equal(userPerms, map[string]string{"alice": "REPO_READ", "bob": "REPO_READ"}); diff != nil {
+		t.Error(diff)
+	}
+	restorePermissions(bb, "repo1", config)
+	if diff := deep.Equal(userPerms, map[string]string{"alice": "REPO_WRITE", "bob": "REPO_READ"}); diff != nil {
+		t.Error(diff)
+	}
+
+	freezeRepo(bb, "repo1", config)
+	if diff := deep.Equal(restrictions, map[string]string{"1": "read-only *"}); diff != nil {
+		t.Error(diff)
+	}
+	unfreezeRepo(bb, "repo1", config)
+	if len(restrictions) != 0 {
+		t.Errorf("expected the freeze to be lifted, got %v", restrictions)
+	}
+
+	prs := getPrs(bb, "PRJ", "repo1", "develop")
+	if len(prs.Values) != 1 {
+		t.Fatalf("expected only the merged PR, got %d PRs", len(prs.Values))
+	}
+	issues := renderClosedPrs(prs)
+	issues[0].Body = strings.Split(issues[0].Body, "\n")[0]
+	if diff := deep.Equal(issues, []plannedIssue{{
+		BitbucketID:       1,
+		Title:             "Historical Bitbucket PR #1: Merged",
+		Body:              "**Bitbucket PR created from branch done on 2024-01-02 03:04:05 by Alice. Merged by Carol**",
+		Labels:            []string{"bitbucketPR"},
+		MergeCommit:       "def",
+		SourceCommit:      "abc",
+		DestinationBranch: "develop",
+		CreatedAt:         time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		ClosedAt:          time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}}); diff != nil {
+		t.Error(diff)
+	}
+
+	comments := getPrComments(bb, "PRJ", "repo1", 1)
+	if len(comments) != 2 {
+		t.Fatalf("expected a comment and its reply, got %+v", comments)
+	}
+	if comments[0].Content.Raw != "why?" || comments[0].Inline["path"] != "main.go" || comments[0].User["display_name"] != "Carol" {
+		t.Errorf("unexpected comment %+v", comments[0])
+	}
+	if comments[1].Content.Raw != "because" || comments[1].Parent["id"] != 11 {
+		t.Errorf("unexpected reply %+v", comments[1])
+	}
+}
+
+func TestCloudPermission(t *testing.T) {
+	for dc, cloud := range map[string]string{"REPO_READ": "read", "REPO_WRITE": "write", "REPO_ADMIN": "admin"} {
+		if got := cloudPermission(dc); got != cloud {
+			t.Errorf("cloudPermission(%s) = %s", dc, got)
+		}
+		if got := dataCenterPermission(cloud); got != dc {
+			t.Errorf("dataCenterPermission(%s) = %s", cloud, got)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCloneRepoReusesMirror(t *testing.T) {
+	bb := newFakeBitbucket(t)
+	gh := newFakeGithub(t)
+	config := fakeSettings(t, bb, gh)
+	seedBitbucketRepo(t, bb, config.bbWorkspace, "repo1")
+	seedBitbucketRepo(t, bb, config.bbWorkspace, "repo1-web")
+
+	other := cloneRepo("repo1-web", nil, config)
+	defer os.RemoveAll(other)
+	first := cloneRepo("repo1", nil, config)
+	// a work copy left behind by a failed run is cleaned up by the next one
+	second := cloneRepo("repo1", nil, config)
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Errorf("expected the old work copy %s to be removed", first)
+	}
+	os.RemoveAll(second)
+	// but the work copy of another repo isn't, even when its name starts with this one's
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("expected the work copy of repo1-web to be kept: %s", err)
+	}
+
+	bare := filepath.Join(bb.gitDir, config.bbWorkspace, "repo1.git")
+	feature := commitTo(t, bare, "feature", "more.txt")
+	work := cloneRepo("repo1", nil, config)
+	defer os.RemoveAll(work)
+
+	for _, dir := range []string{mirrorPath("repo1", config), work} {
+		refs, err := listLocalRefs(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refs["refs/heads/feature"] != feature {
+			t.Errorf("expected %s to have the new commit, got %s", dir, refs["refs/heads/feature"])
+		}
+	}
+	if url := testGit(t, work, "remote", "get-url", "origin"); url != bitbucketCloneURL("repo1", config) {
+		t.Errorf("expected the work copy to fetch from bitbucket, got %s", url)
+	}
+}
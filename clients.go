@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-github/v72/github"
+	"github.com/ktrysmt/go-bitbucket"
+	"golang.org/x/oauth2"
+)
+
+// the bitbucket repository operations btg uses, implemented by *bitbucket.Repository
+type bitbucketRepositoryAPI interface {
+	Get(ro *bitbucket.RepositoryOptions) (*bitbucket.Repository, error)
+	ListUserPermissions(ro *bitbucket.RepositoryOptions) (*bitbucket.UserPermissions, error)
+	ListGroupPermissions(ro *bitbucket.RepositoryOptions) (*bitbucket.GroupPermissions, error)
+	SetUserPermissions(rgo *bitbucket.RepositoryUserPermissionsOptions) (*bitbucket.UserPermission, error)
+	SetGroupPermissions(rgo *bitbucket.RepositoryGroupPermissionsOptions) (*bitbucket.GroupPermission, error)
+}
+
+// the bitbucket pull request operations btg uses, implemented by *bitbucket.PullRequests
+type bitbucketPullRequestsAPI interface {
+	Gets(po *bitbucket.PullRequestsOptions) (interface{}, error)
+	GetComments(po *bitbucket.PullRequestsOptions) (interface{}, error)
+}
+
+// the bitbucket repository changes btg makes around a migration.
+// go-bitbucket can't clear a description or enable issues, so both sources implement this themselves
+type bitbucketSettingsAPI interface {
+	UpdateSettings(owner string, repoSlug string, settings bitbucketRepoSettings) error
+	// commits a single file to branch
+	WriteFile(owner string, repoSlug string, branch string, path string, content []byte, message string) error
+	DeleteFile(owner string, repoSlug string, branch string, path string, message string) error
+	// stops everyone from pushing to or merging into any branch, returns the ids of the restrictions it added
+	// (also when it fails part way)
+	Freeze(owner string, repoSlug string) ([]string, error)
+	// removes one of the restrictions Freeze added
+	Unfreeze(owner string, repoSlug string, id string) error
+}
+
+type bitbucketRepoSettings struct {
+	Description string
+	// nil leaves the setting as it is, Data Center has neither
+	HasIssues *bool
+	HasWiki   *bool
+}
+
+type bitbucketClient struct {
+	Repository   bitbucketRepositoryAPI
+	PullRequests bitbucketPullRequestsAPI
+	Settings     bitbucketSettingsAPI
+}
+
+// authorize sets the credentials of requests the go-bitbucket client doesn't make,
+// it's nil when the http client of c already does that
+func newBitbucketClient(c *bitbucket.Client, authorize func(req *http.Request)) *bitbucketClient {
+	return &bitbucketClient{
+		Repository:   c.Repositories.Repository,
+		PullRequests: c.Repositories.PullRequests,
+		Settings:     &cloudAPI{baseURL: c.GetApiBaseURL(), client: c.HttpClient, authorize: authorize},
+	}
+}
+
+// returns a Bitbucket Data Center client when BITBUCKET_URL is set, Bitbucket Cloud otherwise
+func newSourceClient(config settings) *bitbucketClient {
+	if config.bbURL != "" {
+		if config.bbAuth == bitbucketAuthToken {
+			return newDataCenterClient(config.bbURL, "", config.bbPassword)
+		}
+		return newDataCenterClient(config.bbURL, config.bbUsername, config.bbPassword)
+	}
+	switch config.bbAuth {
+	case bitbucketAuthToken:
+		return newBitbucketClient(bitbucket.NewOAuthbearerToken(config.bbPassword), func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+config.bbPassword)
+		})
+	case bitbucketAuthOAuth:
+		// without credentials of its own the client leaves the auth header to the oauth2 transport
+		c := bitbucket.NewBasicAuth("", "")
+		c.HttpClient = oauth2.NewClient(context.Background(), config.bbTokens)
+		return newBitbucketClient(c, nil)
+	}
+	return newBitbucketClient(bitbucket.NewBasicAuth(config.bbUsername, config.bbPassword), func(req *http.Request) {
+		req.SetBasicAuth(config.bbUsername, config.bbPassword)
+	})
+}
+
+// the github repository operations btg uses, implemented by *github.RepositoriesService
+type githubRepositoriesAPI interface {
+	Create(ctx context.Context, org string, repo *github.Repository) (*github.Repository, *github.Response, error)
+	Get(ctx context.Context, owner, repo string) (*github.Repository, *github.Response, error)
+	Edit(ctx context.Context, owner, repo string, repository *github.Repository) (*github.Repository, *github.Response, error)
+	ReplaceAllTopics(ctx context.Context, owner, repo string, topics []string) ([]string, *github.Response, error)
+	GetAllCustomPropertyValues(ctx context.Context, org, repo string) ([]*github.CustomPropertyValue, *github.Response, error)
+	CreateOrUpdateCustomProperties(ctx context.Context, org, repo string, customPropertyValues []*github.CustomPropertyValue) (*github.Response, error)
+	CreateComment(ctx context.Context, owner, repo, sha string, comment *github.RepositoryComment) (*github.RepositoryComment, *github.Response, error)
+	GetCommit(ctx context.Context, owner, repo, sha string, opts *github.ListOptions) (*github.RepositoryCommit, *github.Response, error)
+	DeleteComment(ctx context.Context, owner, repo string, id int64) (*github.Response, error)
+	Delete(ctx context.Context, owner, repo string) (*github.Response, error)
+}
+
+// the github pull request operations btg uses, implemented by *github.PullRequestsService
+type githubPullRequestsAPI interface {
+	Create(ctx context.Context, owner string, repo string, pull *github.NewPullRequest) (*github.PullRequest, *github.Response, error)
+	List(ctx context.Context, owner string, repo string, opts *github.PullRequestListOptions) ([]*github.PullRequest, *github.Response, error)
+	Edit(ctx context.Context, owner string, repo string, number int, pull *github.PullRequest) (*github.PullRequest, *github.Response, error)
+}
+
+// the github issue operations btg uses, implemented by *github.IssuesService
+type githubIssuesAPI interface {
+	Create(ctx context.Context, owner string, repo string, issue *github.IssueRequest) (*github.Issue, *github.Response, error)
+	Edit(ctx context.Context, owner string, repo string, number int, issue *github.IssueRequest) (*github.Issue, *github.Response, error)
+	ListByRepo(ctx context.Context, owner string, repo string, opts *github.IssueListByRepoOptions) ([]*github.Issue, *github.Response, error)
+	Get(ctx context.Context, owner string, repo string, number int) (*github.Issue, *github.Response, error)
+	AddLabelsToIssue(ctx context.Context, owner string, repo string, number int, labels []string) ([]*github.Label, *github.Response, error)
+}
+
+// the github git database operations btg uses, implemented by *github.GitService
+type githubGitAPI interface {
+	CreateRef(ctx context.Context, owner string, repo string, ref *github.Reference) (*github.Reference, *github.Response, error)
+	UpdateRef(ctx context.Context, owner string, repo string, ref *github.Reference, force bool) (*github.Reference, *github.Response, error)
+	DeleteRef(ctx context.Context, owner string, repo string, ref string) (*github.Response, error)
+}
+
+// imports closed issues with their original timestamps, see https://gist.github.com/jonmagic/5282384165e0f86ef105.
+// go-github's IssueImportService drops the url of the imported issue, so btg has its own
+type githubIssueImportAPI interface {
+	Create(ctx context.Context, owner string, repo string, issue *github.IssueImportRequest) (*issueImportStatus, error)
+	CheckStatus(ctx context.Context, owner string, repo string, id int) (*issueImportStatus, error)
+}
+
+type issueImportStatus struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"` // pending, imported or failed
+	// the API url of the issue once it is imported
+	IssueURL string                     `json:"issue_url"`
+	Errors   []*github.IssueImportError `json:"errors"`
+}
+
+// runs github GraphQL queries, for what the REST API can't do (like deleting issues)
+type githubGraphQLAPI interface {
+	Query(ctx context.Context, query string, variables map[string]any, result any) error
+}
+
+type githubClient struct {
+	Repositories githubRepositoriesAPI
+	PullRequests githubPullRequestsAPI
+	Issues       githubIssuesAPI
+	Git          githubGitAPI
+	GraphQL      githubGraphQLAPI
+	IssueImport  githubIssueImportAPI
+}
+
+func newGithubClient(c *github.Client) *githubClient {
+	return &githubClient{
+		Repositories: c.Repositories,
+		PullRequests: c.PullRequests,
+		Issues:       c.Issues,
+		Git:          c.Git,
+		GraphQL:      &githubGraphQL{client: c, url: githubGraphQLURL(c.BaseURL)},
+		IssueImport:  &githubIssueImport{client: c},
+	}
+}
+
+type githubGraphQL struct {
+	client *github.Client
+	url    string
+}
+
+// the GraphQL endpoint is api/graphql next to api/v3 on Github Enterprise Server and graphql on the API host otherwise
+func githubGraphQLURL(apiURL *url.URL) string {
+	if strings.HasSuffix(apiURL.Path, "/api/v3/") {
+		return apiURL.JoinPath("../graphql").String()
+	}
+	return apiURL.JoinPath("graphql").String()
+}
+
+func (g *githubGraphQL) Query(ctx context.Context, query string, variables map[string]any, result any) error {
+	req, err := g.client.NewRequest("POST", g.url, map[string]any{"query": query, "variables": variables})
+	if err != nil {
+		return err
+	}
+	var response struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	_, err = g.client.Do(ctx, req, &response)
+	if err != nil {
+		return err
+	}
+	if len(response.Errors) > 0 {
+		return errors.New(response.Errors[0].Message)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Data, result)
+}
+
+type githubIssueImport struct {
+	client *github.Client
+}
+
+func (i *githubIssueImport) Create(ctx context.Context, owner string, repo string, issue *github.IssueImportRequest) (*issueImportStatus, error) {
+	return i.do(ctx, "POST", fmt.Sprintf("repos/%s/%s/import/issues", owner, repo), issue)
+}
+
+func (i *githubIssueImport) CheckStatus(ctx context.Context, owner string, repo string, id int) (*issueImportStatus, error) {
+	return i.do(ctx, "GET", fmt.Sprintf("repos/%s/%s/import/issues/%d", owner, repo, id), nil)
+}
+
+func (i *githubIssueImport) do(ctx context.Context, method string, path string, body any) (*issueImportStatus, error) {
+	req, err := i.client.NewRequest(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github.golden-comet-preview+json")
+	status := &issueImportStatus{}
+	_, err = i.client.Do(ctx, req, status)
+	// a new import is 202 Accepted, which go-github returns as an error
+	var accepted *github.AcceptedError
+	if errors.As(err, &accepted) {
+		return status, json.Unmarshal(accepted.Raw, status)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// set in the environment of git when btg is run as its GIT_ASKPASS program
+const (
+	askpassEnv         = "BTG_ASKPASS"
+	askpassUsernameEnv = "BTG_GIT_USERNAME"
+	askpassPasswordEnv = "BTG_GIT_PASSWORD"
+)
+
+// environment that makes git get https credentials from btg itself instead of
+// the operator's credential helpers, so tokens never end up in remote urls, the process list or logs.
+// git runs btg as GIT_ASKPASS, which answers with the credentials it finds in its environment
+func gitCredentialEnv(username string, password string) []string {
+	askpass, err := os.Executable()
+	if err != nil {
+		fatalf("Failed to find the btg executable for GIT_ASKPASS: %s", err)
+	}
+	// config the operator passes to git in the environment is kept, the helper is added after it
+	index, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+	return []string{
+		// an empty helper clears the list of helpers from the user's git config
+		fmt.Sprintf("GIT_CONFIG_COUNT=%d", index+1),
+		fmt.Sprintf("GIT_CONFIG_KEY_%d=credential.helper", index),
+		fmt.Sprintf("GIT_CONFIG_VALUE_%d=", index),
+		"GIT_ASKPASS=" + askpass,
+		// fail instead of hanging on a prompt when the credentials are wrong
+		"GIT_TERMINAL_PROMPT=0",
+		askpassEnv + "=1",
+		askpassUsernameEnv + "=" + username,
+		askpassPasswordEnv + "=" + password,
+	}
+}
+
+// environment for git commands that talk to bitbucket
+func bitbucketGitEnv(config settings) []string {
+	if strings.ToLower(config.cloneVia) == "ssh" {
+		return nil
+	}
+	return gitCredentialEnv(bitbucketGitCredentials(config))
+}
+
+// environment that makes git use a specific ssh key
+func gitSSHKeyEnv(keyFile string) []string {
+	if keyFile == "" {
+		return nil
+	}
+	return []string{fmt.Sprintf("GIT_SSH_COMMAND=ssh -i %s -o IdentitiesOnly=yes", shellQuote(keyFile))}
+}
+
+// quotes s for sh, which git runs GIT_SSH_COMMAND with
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// answers a git prompt like "Username for 'https://bitbucket.org': "
+func askpass(prompt string) string {
+	if strings.HasPrefix(prompt, "Username") {
+		return os.Getenv(askpassUsernameEnv)
+	}
+	return os.Getenv(askpassPasswordEnv)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the test binary is the GIT_ASKPASS program in tests, just like btg is outside of them
+func TestMain(m *testing.M) {
+	if os.Getenv(askpassEnv) != "" && len(os.Args) == 2 {
+		fmt.Println(askpass(os.Args[1]))
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// serves the bare repos in dir over smart http, requiring basic auth
+func newGitHTTPServer(t *testing.T, dir string, username string, password string) *httptest.Server {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + dir, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != username || pass != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGitCredentialEnv(t *testing.T) {
+	dir := t.TempDir()
+	work := filepath.Join(dir, "work")
+	testGit(t, "", "init", "-b", "main", work)
+	os.WriteFile(filepath.Join(work, "readme.md"), []byte("hello"), 0o644)
+	testGit(t, work, "add", ".")
+	testGit(t, work, "commit", "-m", "initial commit")
+	testGit(t, "", "clone", "--bare", work, filepath.Join(dir, "repo.git"))
+
+	server := newGitHTTPServer(t, dir, "x-token-auth", "s3cret")
+	repoURL := server.URL + "/repo.git"
+
+	clone := filepath.Join(t.TempDir(), "clone")
+	output, err := runGitEnv("", gitCredentialEnv("x-token-auth", "s3cret"), "clone", "--mirror", repoURL, clone)
+	if err != nil {
+		t.Fatalf("clone with credentials failed: %s", output)
+	}
+	if config, _ := os.ReadFile(filepath.Join(clone, "config")); strings.Contains(string(config), "s3cret") {
+		t.Error("the token ended up in the repo config")
+	}
+
+	output, err = runGitEnv("", gitCredentialEnv("x-token-auth", "wrong"), "ls-remote", repoURL)
+	if err == nil {
+		t.Errorf("expected wrong credentials to fail, got %s", output)
+	}
+}
+
+func TestGitCredentialEnvKeepsConfig(t *testing.T) {
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "btg.operator")
+	t.Setenv("GIT_CONFIG_VALUE_0", "kept")
+	env := gitCredentialEnv("x-token-auth", "s3cret")
+	for _, args := range [][]string{{"btg.operator", "kept"}, {"credential.helper", ""}} {
+		output, err := runGitEnv("", env, "config", "--get", args[0])
+		if strings.TrimSpace(output) != args[1] {
+			t.Errorf("expected %s to be %q, got %q (%v)", args[0], args[1], output, err)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, path := range []string{"/keys/id_ed25519", "/home/o'brien/.ssh/id rsa", `/keys/$HOME"\`} {
+		output, err := exec.Command("sh", "-c", "printf %s "+shellQuote(path)).CombinedOutput()
+		if err != nil || string(output) != path {
+			t.Errorf("expected sh to read back %q, got %q (%v)", path, output, err)
+		}
+	}
+}
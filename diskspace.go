@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+)
+
+const mb = 1024 * 1024
+
+// fails the migration unless dir has needed bytes free on top of MIN_FREE_SPACE_MB
+func checkDiskSpace(dir string, needed int64, config settings) {
+	free, err := freeDiskSpace(dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		slog.Debug("Can't check free disk space on this platform")
+		return
+	}
+	if err != nil {
+		fatalf("Failed to check free disk space in %s: %s", dir, err)
+	}
+	needed += config.minFreeSpaceMB * mb
+	if free < needed {
+		fatalf("Not enough disk space in %s: %d MB free, %d MB needed", dir, free/mb, needed/mb)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+import "errors"
+
+func freeDiskSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,952 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v72/github"
+	"github.com/ktrysmt/go-bitbucket"
+)
+
+// runs git with a fixed identity and fails the test on error
+func testGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "init.defaultBranch=main"}, args...)
+	output, err := runGit(dir, args...)
+	if err != nil {
+		t.Fatalf("git %v: %s", args, output)
+	}
+	return strings.TrimSpace(output)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// an in process Bitbucket Cloud API serving repos, permissions and PRs.
+// git repos are bare repos under gitDir/<workspace>/<slug>.git
+type fakeBitbucket struct {
+	mu           sync.Mutex
+	server       *httptest.Server
+	gitDir       string
+	repos        map[string]map[string]any    // keyed by workspace/slug
+	userPerms    map[string][]map[string]any  // keyed by workspace/slug
+	groupPerms   map[string][]map[string]any  // keyed by workspace/slug
+	prs          map[string][]map[string]any  // keyed by workspace/slug
+	prComments   map[string][]map[string]any  // keyed by workspace/slug/id
+	files        map[string]map[string]string // committed through the API, keyed by workspace/slug then path
+	restrictions map[string]map[int]string    // branch restriction kinds, keyed by workspace/slug then id
+	nextID       int
+}
+
+func newFakeBitbucket(t *testing.T) *fakeBitbucket {
+	f := &fakeBitbucket{
+		gitDir:       t.TempDir(),
+		repos:        map[string]map[string]any{},
+		userPerms:    map[string][]map[string]any{},
+		groupPerms:   map[string][]map[string]any{},
+		prs:          map[string][]map[string]any{},
+		prComments:   map[string][]map[string]any{},
+		files:        map[string]map[string]string{},
+		restrictions: map[string]map[int]string{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /repositories/{workspace}/{slug}", f.getRepo)
+	mux.HandleFunc("PUT /repositories/{workspace}/{slug}", f.updateRepo)
+	mux.HandleFunc("POST /repositories/{workspace}/{slug}/src", f.commitFiles)
+	mux.HandleFunc("POST /repositories/{workspace}/{slug}/branch-restrictions", f.addRestriction)
+	mux.HandleFunc("DELETE /repositories/{workspace}/{slug}/branch-restrictions/{id}", f.deleteRestriction)
+	mux.HandleFunc("GET /repositories/{workspace}/{slug}/permissions-config/{kind}", f.listPermissions)
+	mux.HandleFunc("PUT /repositories/{workspace}/{slug}/permissions-config/{kind}/{id}", f.setPermission)
+	mux.HandleFunc("GET /repositories/{workspace}/{slug}/pullrequests/", f.listPrs)
+	mux.HandleFunc("GET /repositories/{workspace}/{slug}/pullrequests/{id}/comments/", f.listPrComments)
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeBitbucket) client() *bitbucketClient {
+	c := bitbucket.NewBasicAuth("user", "password")
+	apiURL, _ := url.Parse(f.server.URL)
+	c.SetApiBaseURL(*apiURL)
+	return newBitbucketClient(c, func(req *http.Request) { req.SetBasicAuth("user", "password") })
+}
+
+// adds a repo and returns the path of its bare git repo
+func (f *fakeBitbucket) addRepo(t *testing.T, workspace string, slug string, project string, mainBranch string, private bool) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.repos[workspace+"/"+slug] = map[string]any{
+		"type":        "repository",
+		"slug":        slug,
+		"name":        slug,
+		"full_name":   workspace + "/" + slug,
+		"description": "the " + slug + " repo",
+		"language":    "go",
+		"is_private":  private,
+		"mainbranch":  map[string]any{"type": "branch", "name": mainBranch},
+		"project":     map[string]any{"key": strings.ToUpper(project), "name": project},
+	}
+	dir := filepath.Join(f.gitDir, workspace, slug+".git")
+	testGit(t, "", "init", "--bare", dir)
+	return dir
+}
+
+func (f *fakeBitbucket) addUserPermission(workspace string, slug string, accountID string, username string, permission string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := workspace + "/" + slug
+	f.userPerms[key] = append(f.userPerms[key], map[string]any{
+		"type":       "repository_user_permission",
+		"user":       map[string]any{"account_id": accountID, "username": username, "display_name": username},
+		"permission": permission,
+	})
+}
+
+func (f *fakeBitbucket) addGroupPermission(workspace string, slug string, groupSlug string, permission string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := workspace + "/" + slug
+	f.groupPerms[key] = append(f.groupPerms[key], map[string]any{
+		"type":       "repository_group_permission",
+		"group":      map[string]any{"slug": groupSlug, "name": groupSlug},
+		"permission": permission,
+	})
+}
+
+// adds a PR from sourceBranch, mergeCommit is only used for merged PRs
+func (f *fakeBitbucket) addPr(workspace string, slug string, id int, state string, title string, sourceBranch string, mergeCommit string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := workspace + "/" + slug
+	created := time.Date(2024, 1, id, 12, 0, 0, 0, time.UTC).Format("2006-01-02T15:04:05.000000+00:00")
+	pr := map[string]any{
+		"type":        "pullrequest",
+		"id":          id,
+		"title":       title,
+		"state":       state,
+		"summary":     map[string]any{"raw": "description of " + title},
+		"author":      map[string]any{"display_name": "Author " + strconv.Itoa(id)},
+		"source":      f.prSource(workspace, slug, sourceBranch),
+		"destination": map[string]any{"branch": map[string]any{"name": f.repos[key]["mainbranch"].(map[string]any)["name"]}, "repository": map[string]any{"full_name": key}},
+		"created_on":  created,
+		"updated_on":  created,
+	}
+	if state == "MERGED" {
+		pr["merge_commit"] = map[string]any{"hash": mergeCommit}
+		pr["closed_by"] = map[string]any{"display_name": "Merger"}
+	}
+	f.prs[key] = append(f.prs[key], pr)
+}
+
+// merges the PR id
+func (f *fakeBitbucket) mergePr(workspace string, slug string, id int, mergeCommit string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, pr := range f.prs[workspace+"/"+slug] {
+		if pr["id"] == id {
+			pr["state"] = "MERGED"
+			pr["merge_commit"] = map[string]any{"hash": mergeCommit}
+			pr["closed_by"] = map[string]any{"display_name": "Merger"}
+		}
+	}
+}
+
+// declines the PR id
+func (f *fakeBitbucket) declinePr(workspace string, slug string, id int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, pr := range f.prs[workspace+"/"+slug] {
+		if pr["id"] == id {
+			pr["state"] = "DECLINED"
+		}
+	}
+}
+
+// adds an open PR from branch of the fork forkWorkspace/forkSlug
+func (f *fakeBitbucket) addForkPr(workspace string, slug string, id int, title string, forkWorkspace string, forkSlug string, branch string) {
+	f.addPr(workspace, slug, id, "OPEN", title, branch, "")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	prs := f.prs[workspace+"/"+slug]
+	prs[len(prs)-1]["source"] = f.prSource(forkWorkspace, forkSlug, branch)
+}
+
+func (f *fakeBitbucket) prSource(workspace string, slug string, branch string) map[string]any {
+	source := map[string]any{"branch": map[string]any{"name": branch}, "repository": map[string]any{"full_name": workspace + "/" + slug}}
+	// abbreviated like bitbucket does
+	commit, err := runGit(filepath.Join(f.gitDir, workspace, slug+".git"), "rev-parse", "--short=12", "--verify", "--quiet", "refs/heads/"+branch)
+	if err == nil {
+		source["commit"] = map[string]any{"hash": strings.TrimSpace(commit)}
+	}
+	return source
+}
+
+// inline is nil for comments on the PR itself
+func (f *fakeBitbucket) addPrComment(workspace string, slug string, prID int, author string, body string, inline map[string]any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := fmt.Sprintf("%s/%s/%d", workspace, slug, prID)
+	f.nextID++
+	f.prComments[key] = append(f.prComments[key], map[string]any{
+		"type":       "pullrequest_comment",
+		"id":         f.nextID,
+		"content":    map[string]any{"raw": body},
+		"user":       map[string]any{"display_name": author},
+		"created_on": "2024-01-05T12:00:00.000000+00:00",
+		"updated_on": "2024-01-05T12:00:00.000000+00:00",
+		"inline":     inline,
+	})
+}
+
+// returns the permission of a user or group, or "" when it has none
+func (f *fakeBitbucket) permission(workspace string, slug string, kind string, id string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	perms, idKey := f.userPerms, "account_id"
+	if kind == "group" {
+		perms, idKey = f.groupPerms, "slug"
+	}
+	for _, perm := range perms[workspace+"/"+slug] {
+		if perm[kind].(map[string]any)[idKey] == id {
+			return perm["permission"].(string)
+		}
+	}
+	return ""
+}
+
+func bitbucketNotFound(w http.ResponseWriter) {
+	writeJSON(w, http.StatusNotFound, map[string]any{"type": "error", "error": map[string]any{"message": "not found"}})
+}
+
+func (f *fakeBitbucket) getRepo(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	repo, ok := f.repos[r.PathValue("workspace")+"/"+r.PathValue("slug")]
+	if !ok {
+		bitbucketNotFound(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, repo)
+}
+
+func (f *fakeBitbucket) updateRepo(w http.ResponseWriter, r *http.Request) {
+	var body map[string]any
+	json.NewDecoder(r.Body).Decode(&body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	repo, ok := f.repos[r.PathValue("workspace")+"/"+r.PathValue("slug")]
+	if !ok {
+		bitbucketNotFound(w)
+		return
+	}
+	for _, field := range []string{"description", "has_issues", "has_wiki"} {
+		if value, ok := body[field]; ok {
+			repo[field] = value
+		}
+	}
+	writeJSON(w, http.StatusOK, repo)
+}
+
+func (f *fakeBitbucket) commitFiles(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := r.PathValue("workspace") + "/" + r.PathValue("slug")
+	if len(f.restrictions[key]) > 0 {
+		writeJSON(w, http.StatusForbidden, map[string]any{"type": "error", "error": map[string]any{"message": "branch restricted"}})
+		return
+	}
+	if f.files[key] == nil {
+		f.files[key] = map[string]string{}
+	}
+	for name, values := range r.MultipartForm.Value {
+		switch name {
+		case "message", "branch", "author":
+		case "files":
+			for _, path := range values {
+				delete(f.files[key], path)
+			}
+		default:
+			f.files[key][name] = values[0]
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeBitbucket) addRestriction(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Kind string `json:"kind"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := r.PathValue("workspace") + "/" + r.PathValue("slug")
+	if f.restrictions[key] == nil {
+		f.restrictions[key] = map[int]string{}
+	}
+	f.nextID++
+	f.restrictions[key][f.nextID] = body.Kind
+	writeJSON(w, http.StatusCreated, map[string]any{"id": f.nextID, "kind": body.Kind})
+}
+
+func (f *fakeBitbucket) deleteRestriction(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := r.PathValue("workspace") + "/" + r.PathValue("slug")
+	id, _ := strconv.Atoi(r.PathValue("id"))
+	if _, ok := f.restrictions[key][id]; !ok {
+		bitbucketNotFound(w)
+		return
+	}
+	delete(f.restrictions[key], id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeBitbucket) listPermissions(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	perms := f.userPerms
+	if r.PathValue("kind") == "groups" {
+		perms = f.groupPerms
+	}
+	values := perms[r.PathValue("workspace")+"/"+r.PathValue("slug")]
+	if values == nil {
+		values = []map[string]any{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"page": 1, "pagelen": len(values), "size": len(values), "values": values})
+}
+
+func (f *fakeBitbucket) setPermission(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Permission string `json:"permission"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := r.PathValue("workspace") + "/" + r.PathValue("slug")
+	perms, kind, idKey := f.userPerms, "user", "account_id"
+	if r.PathValue("kind") == "groups" {
+		perms, kind, idKey = f.groupPerms, "group", "slug"
+	}
+	for _, perm := range perms[key] {
+		if perm[kind].(map[string]any)[idKey] == r.PathValue("id") {
+			perm["permission"] = body.Permission
+			writeJSON(w, http.StatusOK, perm)
+			return
+		}
+	}
+	bitbucketNotFound(w)
+}
+
+func (f *fakeBitbucket) listPrs(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	values := []map[string]any{}
+	for _, pr := range f.prs[r.PathValue("workspace")+"/"+r.PathValue("slug")] {
+		// btg's queries only ever filter on the state
+		if strings.Contains(r.URL.Query().Get("q"), fmt.Sprintf("%q", pr["state"])) {
+			values = append(values, pr)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"page": 1, "pagelen": len(values), "size": len(values), "values": values})
+}
+
+func (f *fakeBitbucket) listPrComments(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	values := f.prComments[r.PathValue("workspace")+"/"+r.PathValue("slug")+"/"+r.PathValue("id")]
+	if values == nil {
+		values = []map[string]any{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"page": 1, "pagelen": len(values), "size": len(values), "values": values})
+}
+
+// an in process GitHub API, creating a repo also creates a bare git repo
+// under gitDir/<owner>/<name>.git to push to
+type fakeGithub struct {
+	mu     sync.Mutex
+	server *httptest.Server
+	gitDir string
+	repos  map[string]*fakeGithubRepo // keyed by owner/name
+	// answers the issue import API with 404 like GHES versions without it
+	noIssueImport bool
+	// fails editing PRs, for example to close them
+	failPullEdits bool
+}
+
+type fakeGithubRepo struct {
+	repo       github.Repository
+	topics     []string
+	properties []*github.CustomPropertyValue
+	pulls      []*github.PullRequest
+	issues     []*github.Issue
+	comments   map[string][]string // commit sha to comment bodies
+	commentIDs map[int64][2]string // comment id to commit sha and body
+	nextNumber int
+	imports    []*github.Issue // issue imports by id - 1
+}
+
+func newFakeGithub(t *testing.T) *fakeGithub {
+	f := &fakeGithub{
+		gitDir: t.TempDir(),
+		repos:  map[string]*fakeGithubRepo{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /orgs/{owner}/repos", f.createRepo)
+	mux.HandleFunc("POST /user/repos", f.createRepo)
+	mux.HandleFunc("GET /repos/{owner}/{repo}", f.withRepo(f.getRepo))
+	mux.HandleFunc("PATCH /repos/{owner}/{repo}", f.withRepo(f.editRepo))
+	mux.HandleFunc("PUT /repos/{owner}/{repo}/topics", f.withRepo(f.replaceTopics))
+	mux.HandleFunc("GET /repos/{owner}/{repo}/properties/values", f.withRepo(f.getProperties))
+	mux.HandleFunc("PATCH /repos/{owner}/{repo}/properties/values", f.withRepo(f.updateProperties))
+	mux.HandleFunc("POST /repos/{owner}/{repo}/pulls", f.withRepo(f.createPull))
+	mux.HandleFunc("GET /repos/{owner}/{repo}/pulls", f.withRepo(f.listPulls))
+	mux.HandleFunc("POST /repos/{owner}/{repo}/issues", f.withRepo(f.createIssue))
+	mux.HandleFunc("PATCH /repos/{owner}/{repo}/issues/{number}", f.withRepo(f.editIssue))
+	mux.HandleFunc("GET /repos/{owner}/{repo}/issues", f.withRepo(f.listIssues))
+	mux.HandleFunc("GET /repos/{owner}/{repo}/issues/{number}", f.withRepo(f.getIssue))
+	mux.HandleFunc("POST /repos/{owner}/{repo}/import/issues", f.withRepo(f.importIssue))
+	mux.HandleFunc("GET /repos/{owner}/{repo}/import/issues/{id}", f.withRepo(f.getIssueImport))
+	mux.HandleFunc("POST /repos/{owner}/{repo}/issues/{number}/labels", f.withRepo(f.addLabels))
+	mux.HandleFunc("GET /repos/{owner}/{repo}/commits/{sha}", f.withRepo(f.getCommit))
+	mux.HandleFunc("POST /repos/{owner}/{repo}/commits/{sha}/comments", f.withRepo(f.createComment))
+	mux.HandleFunc("POST /repos/{owner}/{repo}/git/refs", f.withRepo(f.createRef))
+	mux.HandleFunc("PATCH /repos/{owner}/{repo}/git/refs/{ref...}", f.withRepo(f.updateRef))
+	mux.HandleFunc("DELETE /repos/{owner}/{repo}/git/refs/{ref...}", f.withRepo(f.deleteRef))
+	mux.HandleFunc("DELETE /repos/{owner}/{repo}/comments/{id}", f.withRepo(f.deleteComment))
+	mux.HandleFunc("DELETE /repos/{owner}/{repo}", f.withRepo(f.deleteRepo))
+	mux.HandleFunc("PATCH /repos/{owner}/{repo}/pulls/{number}", f.withRepo(f.editPull))
+	mux.HandleFunc("POST /graphql", f.graphql)
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeGithub) client() *githubClient {
+	c := github.NewClient(nil)
+	c.BaseURL, _ = url.Parse(f.server.URL + "/")
+	return newGithubClient(c)
+}
+
+func (f *fakeGithub) target(config settings) *githubTarget {
+	return &githubTarget{gh: f.client(), config: config, tokens: staticToken(config.ghToken)}
+}
+
+func (f *fakeGithub) repo(owner string, name string) *fakeGithubRepo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.repos[owner+"/"+name]
+}
+
+func githubError(w http.ResponseWriter, status int, message string, errors ...map[string]any) {
+	writeJSON(w, status, map[string]any{"message": message, "errors": errors})
+}
+
+// looks up the repo in the path and holds the lock while handling the request
+func (f *fakeGithub) withRepo(handler func(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		repo, ok := f.repos[r.PathValue("owner")+"/"+r.PathValue("repo")]
+		if !ok {
+			githubError(w, http.StatusNotFound, "Not Found")
+			return
+		}
+		handler(w, r, repo)
+	}
+}
+
+func (f *fakeGithub) createRepo(w http.ResponseWriter, r *http.Request) {
+	var repo github.Repository
+	json.NewDecoder(r.Body).Decode(&repo)
+	owner := r.PathValue("owner")
+	if owner == "" {
+		owner = "user"
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := owner + "/" + repo.GetName()
+	if _, exists := f.repos[key]; exists {
+		githubError(w, http.StatusUnprocessableEntity, "Repository creation failed.",
+			map[string]any{"resource": "Repository", "code": "custom", "field": "name", "message": "name already exists on this account"})
+		return
+	}
+	gitDir := filepath.Join(f.gitDir, owner, repo.GetName()+".git")
+	output, err := runGit("", "init", "--bare", gitDir)
+	if err != nil {
+		githubError(w, http.StatusInternalServerError, output)
+		return
+	}
+	repo.Owner = &github.User{Login: github.Ptr(owner)}
+	repo.FullName = github.Ptr(key)
+	// github ignores the default branch on creation, the first push decides it
+	repo.DefaultBranch = nil
+	f.repos[key] = &fakeGithubRepo{repo: repo, comments: map[string][]string{}, commentIDs: map[int64][2]string{}, nextNumber: 1}
+	writeJSON(w, http.StatusCreated, repo)
+}
+
+// adds a fork of parent, like forking a repo on Github does. Returns its git directory
+func (f *fakeGithub) addFork(t *testing.T, owner string, name string, parent string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := owner + "/" + name
+	gitDir := filepath.Join(f.gitDir, key+".git")
+	testGit(t, "", "init", "--bare", gitDir)
+	f.repos[key] = &fakeGithubRepo{
+		repo: github.Repository{
+			Name:     github.Ptr(name),
+			FullName: github.Ptr(key),
+			Owner:    &github.User{Login: github.Ptr(owner)},
+			Fork:     github.Ptr(true),
+			Parent:   &github.Repository{FullName: github.Ptr(parent)},
+		},
+		comments:   map[string][]string{},
+		commentIDs: map[int64][2]string{},
+		nextNumber: 1,
+	}
+	return gitDir
+}
+
+func (f *fakeGithub) gitRepoDir(repo *fakeGithubRepo) string {
+	return filepath.Join(f.gitDir, repo.repo.GetFullName()+".git")
+}
+
+func (f *fakeGithub) getRepo(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	result := repo.repo
+	if result.DefaultBranch == nil {
+		// like github, fall back to what HEAD of the pushed repo points to
+		head, err := runGit(f.gitRepoDir(repo), "symbolic-ref", "--short", "HEAD")
+		if err == nil {
+			result.DefaultBranch = github.Ptr(strings.TrimSpace(head))
+		}
+	}
+	result.Topics = repo.topics
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (f *fakeGithub) editRepo(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	var edit github.Repository
+	json.NewDecoder(r.Body).Decode(&edit)
+	if edit.DefaultBranch != nil {
+		repo.repo.DefaultBranch = edit.DefaultBranch
+	}
+	if edit.Description != nil {
+		repo.repo.Description = edit.Description
+	}
+	if edit.Visibility != nil {
+		repo.repo.Visibility = edit.Visibility
+	}
+	if edit.Archived != nil {
+		repo.repo.Archived = edit.Archived
+	}
+	writeJSON(w, http.StatusOK, repo.repo)
+}
+
+func (f *fakeGithub) replaceTopics(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	var body struct {
+		Names []string `json:"names"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	// github stores topics in lowercase
+	repo.topics = []string{}
+	for _, topic := range body.Names {
+		repo.topics = append(repo.topics, strings.ToLower(topic))
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (f *fakeGithub) getProperties(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	writeJSON(w, http.StatusOK, repo.properties)
+}
+
+func (f *fakeGithub) updateProperties(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	var body struct {
+		Properties []*github.CustomPropertyValue `json:"properties"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	repo.properties = body.Properties
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeGithub) createPull(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	var pull github.NewPullRequest
+	json.NewDecoder(r.Body).Decode(&pull)
+	headDir := f.gitRepoDir(repo)
+	if pull.HeadRepo != nil {
+		// a fork in the same owner
+		fork, ok := f.repos[repo.repo.GetOwner().GetLogin()+"/"+pull.GetHeadRepo()]
+		if !ok || fork.repo.GetParent().GetFullName() != repo.repo.GetFullName() {
+			githubError(w, http.StatusUnprocessableEntity, "Validation Failed",
+				map[string]any{"resource": "PullRequest", "field": "head_repo", "code": "invalid"})
+			return
+		}
+		headDir = f.gitRepoDir(fork)
+	}
+	head, err := runGit(headDir, "rev-parse", "--verify", "refs/heads/"+pull.GetHead())
+	if err != nil {
+		githubError(w, http.StatusUnprocessableEntity, "Validation Failed",
+			map[string]any{"resource": "PullRequest", "field": "head", "code": "invalid"})
+		return
+	}
+	if _, err := runGit(f.gitRepoDir(repo), "rev-parse", "--verify", "refs/heads/"+pull.GetBase()); err != nil {
+		githubError(w, http.StatusUnprocessableEntity, "Validation Failed",
+			map[string]any{"resource": "PullRequest", "field": "base", "code": "invalid"})
+		return
+	}
+	// forks don't share objects with their parent here
+	commits, _ := runGit(f.gitRepoDir(repo), "rev-list", "refs/heads/"+pull.GetBase()+"..refs/heads/"+pull.GetHead())
+	if pull.HeadRepo == nil && strings.TrimSpace(commits) == "" {
+		githubError(w, http.StatusUnprocessableEntity, "Validation Failed",
+			map[string]any{"resource": "PullRequest", "code": "custom", "message": "No commits between " + pull.GetBase() + " and " + pull.GetHead()})
+		return
+	}
+	for _, existing := range repo.pulls {
+		if existing.GetHead().GetRef() == pull.GetHead() && existing.GetHead().GetRepo().GetName() == pull.GetHeadRepo() && existing.GetState() == "open" {
+			githubError(w, http.StatusUnprocessableEntity, "Validation Failed",
+				map[string]any{"resource": "PullRequest", "code": "custom", "message": "A pull request already exists for " + pull.GetHead() + "."})
+			return
+		}
+	}
+	created := &github.PullRequest{
+		Number: github.Ptr(repo.nextNumber),
+		Title:  pull.Title,
+		Body:   pull.Body,
+		State:  github.Ptr("open"),
+		Draft:  pull.Draft,
+		Head:   &github.PullRequestBranch{Ref: pull.Head, SHA: github.Ptr(strings.TrimSpace(head)), Repo: &github.Repository{Name: pull.HeadRepo}},
+		Base:   &github.PullRequestBranch{Ref: pull.Base},
+	}
+	repo.nextNumber++
+	repo.pulls = append(repo.pulls, created)
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (f *fakeGithub) listPulls(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	writeJSON(w, http.StatusOK, repo.pulls)
+}
+
+func (f *fakeGithub) createIssue(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	var request github.IssueRequest
+	json.NewDecoder(r.Body).Decode(&request)
+	issue := &github.Issue{
+		Number: github.Ptr(repo.nextNumber),
+		Title:  request.Title,
+		Body:   request.Body,
+		// the state can't be set on creation
+		State:  github.Ptr("open"),
+		URL:    github.Ptr(fmt.Sprintf("%s/repos/%s/issues/%d", f.server.URL, repo.repo.GetFullName(), repo.nextNumber)),
+		NodeID: github.Ptr(fmt.Sprintf("issue:%s#%d", repo.repo.GetFullName(), repo.nextNumber)),
+	}
+	if request.Labels != nil {
+		for _, label := range *request.Labels {
+			issue.Labels = append(issue.Labels, &github.Label{Name: github.Ptr(label)})
+		}
+	}
+	repo.nextNumber++
+	repo.issues = append(repo.issues, issue)
+	writeJSON(w, http.StatusCreated, issue)
+}
+
+func (f *fakeGithub) editIssue(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	var request github.IssueRequest
+	json.NewDecoder(r.Body).Decode(&request)
+	number, _ := strconv.Atoi(r.PathValue("number"))
+	for _, issue := range repo.issues {
+		if issue.GetNumber() == number {
+			if request.State != nil {
+				issue.State = request.State
+			}
+			if request.Title != nil {
+				issue.Title = request.Title
+			}
+			if request.Body != nil {
+				issue.Body = request.Body
+			}
+			writeJSON(w, http.StatusOK, issue)
+			return
+		}
+	}
+	githubError(w, http.StatusNotFound, "Not Found")
+}
+
+func (f *fakeGithub) getIssue(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	number, _ := strconv.Atoi(r.PathValue("number"))
+	for _, issue := range repo.issues {
+		if issue.GetNumber() == number {
+			writeJSON(w, http.StatusOK, issue)
+			return
+		}
+	}
+	githubError(w, http.StatusNotFound, "Not Found")
+}
+
+// imports finish on the first status check
+func (f *fakeGithub) importIssue(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	if f.noIssueImport {
+		githubError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	var request github.IssueImportRequest
+	json.NewDecoder(r.Body).Decode(&request)
+	state := "open"
+	if request.IssueImport.GetClosed() {
+		state = "closed"
+	}
+	issue := &github.Issue{
+		Number:    github.Ptr(repo.nextNumber),
+		Title:     github.Ptr(request.IssueImport.Title),
+		Body:      github.Ptr(request.IssueImport.Body),
+		State:     github.Ptr(state),
+		CreatedAt: request.IssueImport.CreatedAt,
+		ClosedAt:  request.IssueImport.ClosedAt,
+		URL:       github.Ptr(fmt.Sprintf("%s/repos/%s/issues/%d", f.server.URL, repo.repo.GetFullName(), repo.nextNumber)),
+		NodeID:    github.Ptr(fmt.Sprintf("issue:%s#%d", repo.repo.GetFullName(), repo.nextNumber)),
+	}
+	for _, label := range request.IssueImport.Labels {
+		issue.Labels = append(issue.Labels, &github.Label{Name: github.Ptr(label)})
+	}
+	repo.nextNumber++
+	repo.imports = append(repo.imports, issue)
+	writeJSON(w, http.StatusAccepted, map[string]any{"id": len(repo.imports), "status": "pending"})
+}
+
+func (f *fakeGithub) getIssueImport(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	id, _ := strconv.Atoi(r.PathValue("id"))
+	if id < 1 || id > len(repo.imports) {
+		githubError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	issue := repo.imports[id-1]
+	if !slices.Contains(repo.issues, issue) {
+		repo.issues = append(repo.issues, issue)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "status": "imported", "issue_url": issue.GetURL()})
+}
+
+// lists PRs as issues too, like Github does
+func (f *fakeGithub) listIssues(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	issues := slices.Clone(repo.issues)
+	for _, pull := range repo.pulls {
+		issues = append(issues, &github.Issue{
+			Number:           pull.Number,
+			Title:            pull.Title,
+			State:            pull.State,
+			Labels:           pull.Labels,
+			PullRequestLinks: &github.PullRequestLinks{URL: pull.URL},
+		})
+	}
+	if label := r.URL.Query().Get("labels"); label != "" {
+		issues = slices.DeleteFunc(issues, func(issue *github.Issue) bool {
+			return !slices.ContainsFunc(issue.Labels, func(l *github.Label) bool { return l.GetName() == label })
+		})
+	}
+	writeJSON(w, http.StatusOK, issues)
+}
+
+// labels issues and PRs
+func (f *fakeGithub) addLabels(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	var names []string
+	json.NewDecoder(r.Body).Decode(&names)
+	number, _ := strconv.Atoi(r.PathValue("number"))
+	labels := []*github.Label{}
+	for _, name := range names {
+		labels = append(labels, &github.Label{Name: github.Ptr(name)})
+	}
+	for _, pull := range repo.pulls {
+		if pull.GetNumber() == number {
+			pull.Labels = append(pull.Labels, labels...)
+			writeJSON(w, http.StatusOK, pull.Labels)
+			return
+		}
+	}
+	for _, issue := range repo.issues {
+		if issue.GetNumber() == number {
+			issue.Labels = append(issue.Labels, labels...)
+			writeJSON(w, http.StatusOK, issue.Labels)
+			return
+		}
+	}
+	githubError(w, http.StatusNotFound, "Not Found")
+}
+
+// resolves abbreviated shas like Github does
+func (f *fakeGithub) getCommit(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	output, err := runGit(f.gitRepoDir(repo), "rev-list", "--parents", "-n", "1", r.PathValue("sha")+"^{commit}", "--")
+	if err != nil {
+		githubError(w, http.StatusUnprocessableEntity, "No commit found for SHA: "+r.PathValue("sha"))
+		return
+	}
+	shas := strings.Fields(output)
+	commit := &github.RepositoryCommit{SHA: github.Ptr(shas[0])}
+	for _, parent := range shas[1:] {
+		commit.Parents = append(commit.Parents, &github.Commit{SHA: github.Ptr(parent)})
+	}
+	writeJSON(w, http.StatusOK, commit)
+}
+
+func (f *fakeGithub) createRef(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	var ref struct {
+		Ref string `json:"ref"`
+		SHA string `json:"sha"`
+	}
+	json.NewDecoder(r.Body).Decode(&ref)
+	// the empty old value makes update-ref fail when the ref exists
+	_, err := runGit(f.gitRepoDir(repo), "update-ref", ref.Ref, ref.SHA, "")
+	if err != nil {
+		githubError(w, http.StatusUnprocessableEntity, "Reference already exists or object does not exist")
+		return
+	}
+	writeJSON(w, http.StatusCreated, &github.Reference{Ref: github.Ptr(ref.Ref), Object: &github.GitObject{SHA: github.Ptr(ref.SHA)}})
+}
+
+// only forced updates
+func (f *fakeGithub) updateRef(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	var update struct {
+		SHA   string `json:"sha"`
+		Force bool   `json:"force"`
+	}
+	json.NewDecoder(r.Body).Decode(&update)
+	ref := "refs/" + r.PathValue("ref")
+	_, err := runGit(f.gitRepoDir(repo), "update-ref", ref, update.SHA)
+	if err != nil || !update.Force {
+		githubError(w, http.StatusUnprocessableEntity, "Update is not a fast forward")
+		return
+	}
+	writeJSON(w, http.StatusOK, &github.Reference{Ref: github.Ptr(ref), Object: &github.GitObject{SHA: github.Ptr(update.SHA)}})
+}
+
+// closes the open PRs from or into deleted branches like Github does
+func (f *fakeGithub) deleteRef(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	ref := "refs/" + r.PathValue("ref")
+	if _, err := runGit(f.gitRepoDir(repo), "rev-parse", "--verify", "--quiet", ref); err != nil {
+		githubError(w, http.StatusUnprocessableEntity, "Reference does not exist")
+		return
+	}
+	runGit(f.gitRepoDir(repo), "update-ref", "-d", ref)
+	branch := strings.TrimPrefix(ref, "refs/heads/")
+	for _, pull := range repo.pulls {
+		if pull.GetHead().GetRepo().GetName() == "" && (pull.GetHead().GetRef() == branch || pull.GetBase().GetRef() == branch) {
+			pull.State = github.Ptr("closed")
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeGithub) createComment(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	var comment github.RepositoryComment
+	json.NewDecoder(r.Body).Decode(&comment)
+	sha := r.PathValue("sha")
+	_, err := runGit(f.gitRepoDir(repo), "cat-file", "-e", sha+"^{commit}")
+	if err != nil {
+		githubError(w, http.StatusUnprocessableEntity, "No commit found for SHA: "+sha)
+		return
+	}
+	repo.comments[sha] = append(repo.comments[sha], comment.GetBody())
+	comment.ID = github.Ptr(int64(len(repo.commentIDs) + 1))
+	repo.commentIDs[comment.GetID()] = [2]string{sha, comment.GetBody()}
+	writeJSON(w, http.StatusCreated, comment)
+}
+
+func (f *fakeGithub) deleteComment(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	comment, ok := repo.commentIDs[id]
+	if !ok {
+		githubError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	sha, body := comment[0], comment[1]
+	repo.comments[sha] = slices.DeleteFunc(repo.comments[sha], func(b string) bool { return b == body })
+	delete(repo.commentIDs, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeGithub) deleteRepo(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	delete(f.repos, repo.repo.GetFullName())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeGithub) editPull(w http.ResponseWriter, r *http.Request, repo *fakeGithubRepo) {
+	if f.failPullEdits {
+		githubError(w, http.StatusInternalServerError, "Server Error")
+		return
+	}
+	var edit github.PullRequest
+	json.NewDecoder(r.Body).Decode(&edit)
+	number, _ := strconv.Atoi(r.PathValue("number"))
+	for _, pull := range repo.pulls {
+		if pull.GetNumber() == number {
+			if edit.State != nil {
+				pull.State = edit.State
+			}
+			writeJSON(w, http.StatusOK, pull)
+			return
+		}
+	}
+	githubError(w, http.StatusNotFound, "Not Found")
+}
+
+// only knows the deleteIssue mutation
+func (f *fakeGithub) graphql(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Query     string         `json:"query"`
+		Variables map[string]any `json:"variables"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if strings.Contains(body.Query, "deleteIssue") {
+		for _, repo := range f.repos {
+			for i, issue := range repo.issues {
+				if issue.GetNodeID() == body.Variables["issueId"] {
+					repo.issues = slices.Delete(repo.issues, i, i+1)
+					writeJSON(w, http.StatusOK, map[string]any{"data": map[string]any{"deleteIssue": map[string]any{}}})
+					return
+				}
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"errors": []map[string]any{{"message": "Could not resolve to a node"}}})
+}
+
+// returns settings that point every client and git remote at the fakes
+func fakeSettings(t *testing.T, bb *fakeBitbucket, gh *fakeGithub) settings {
+	return settings{
+		bbWorkspace:         "workspace",
+		bbUsername:          "user",
+		bbPassword:          "password",
+		revokeOldPerms:      true,
+		cloneVia:            "https",
+		ghOrg:               "org",
+		ghOwner:             "org",
+		ghToken:             "token",
+		visibility:          "private",
+		runProgram:          "noop",
+		migrateRepoContents: true,
+		migrateRepoSettings: true,
+		migrateOpenPrs:      true,
+		migrateClosedPrs:    true,
+		migrateLfs:          true,
+		largeFileAction:     "fail",
+		bbGitURL:            bb.gitDir,
+		ghBaseURL:           gh.gitDir,
+		stateDir:            t.TempDir(),
+		mirrorDir:           t.TempDir(),
+	}
+}
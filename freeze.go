@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log/slog"
+)
+
+// the restrictions freezeRepo added, so unfreezeRepo can remove them
+type freezeState struct {
+	RestrictionIDs []string `json:"restrictionIds"`
+}
+
+// makes the repo read only for everyone, regardless of repo, project or workspace permissions
+func freezeRepo(bb *bitbucketClient, repoName string, config settings) {
+	if readState(config, repoName, "freeze", &freezeState{}) {
+		slog.Info("Bitbucket repo is already frozen")
+		return
+	}
+	if config.dryRun {
+		slog.Info("Mock freezing bitbucket repo")
+		return
+	}
+	slog.Info("Freezing bitbucket repo, nobody can push to it any more")
+	ids, err := bb.Settings.Freeze(config.bbWorkspace, repoName)
+	if len(ids) > 0 {
+		writeState(config, repoName, "freeze", freezeState{RestrictionIDs: ids})
+	}
+	if err != nil {
+		fatalf("Failed to freeze bitbucket repo: %s", err)
+	}
+}
+
+// removes the restrictions added by freezeRepo
+func unfreezeRepo(bb *bitbucketClient, repoName string, config settings) {
+	var state freezeState
+	if !readState(config, repoName, "freeze", &state) {
+		return
+	}
+	if config.dryRun {
+		slog.Info("Mock unfreezing bitbucket repo", "repo", repoName)
+		return
+	}
+	slog.Info("Unfreezing bitbucket repo", "repo", repoName)
+	for len(state.RestrictionIDs) > 0 {
+		err := bb.Settings.Unfreeze(config.bbWorkspace, repoName, state.RestrictionIDs[0])
+		if err != nil {
+			fatalf("Failed to unfreeze bitbucket repo %s: %s", repoName, err)
+		}
+		// so a failure part way doesn't leave ids of removed restrictions behind
+		state.RestrictionIDs = state.RestrictionIDs[1:]
+		writeState(config, repoName, "freeze", state)
+	}
+	removeState(config, repoName, "freeze")
+}
+
+// runs f with the freeze lifted, for btg's own commits to a frozen repo.
+// f returns its error instead of exiting so the repo is always frozen again
+func withoutFreeze(bb *bitbucketClient, repoName string, config settings, f func() error) error {
+	frozen := readState(config, repoName, "freeze", &freezeState{})
+	if frozen {
+		unfreezeRepo(bb, repoName, config)
+	}
+	err := f()
+	if frozen {
+		freezeRepo(bb, repoName, config)
+	}
+	return err
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the version of the ghe-migrator archive layout that Github's importers read
+const geiSchemaVersion = "1.2.0"
+
+// the timestamp format of ghe-migrator archives
+const geiTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+func geiArchivePath(dir string, repoName string) string {
+	return filepath.Join(dir, repoName+".gei.tar.gz")
+}
+
+// builds the records of a ghe-migrator archive from what btg fetched from bitbucket.
+// Records point at each other by url, these are the urls the records will have on the target
+type geiArchive struct {
+	baseURL  string
+	owner    string
+	repoName string
+	// keyed by url
+	users          map[string]map[string]any
+	pullRequests   []map[string]any
+	reviewComments []map[string]any
+	issueComments  []map[string]any
+}
+
+func (a *geiArchive) repoURL() string {
+	return fmt.Sprintf("%s/%s/%s", a.baseURL, a.owner, a.repoName)
+}
+
+func (a *geiArchive) pullRequestURL(prID int) string {
+	return fmt.Sprintf("%s/pull/%d", a.repoURL(), prID)
+}
+
+var nonLoginChars = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// returns the url of a bitbucket user, adding them to the archive.
+// Bitbucket users have no Github login, so the importer maps them like any other unknown user
+func (a *geiArchive) user(bbUser map[string]any) string {
+	login, _ := bbUser["nickname"].(string)
+	name, _ := bbUser["display_name"].(string)
+	if login == "" {
+		login = strings.Trim(nonLoginChars.ReplaceAllString(name, "-"), "-")
+	}
+	if login == "" {
+		login = "ghost"
+	}
+	url := a.baseURL + "/" + login
+	if _, ok := a.users[url]; !ok {
+		a.users[url] = map[string]any{
+			"type":       "user",
+			"url":        url,
+			"login":      login,
+			"name":       name,
+			"company":    nil,
+			"website":    nil,
+			"location":   nil,
+			"emails":     []any{},
+			"created_at": time.Unix(0, 0).UTC().Format(geiTimeFormat),
+		}
+	}
+	return url
+}
+
+// resolves the commit of a PR side, bitbucket only returns abbreviated hashes
+func resolvePrCommit(repoFolder string, side map[string]any) string {
+	candidates := []string{}
+	if hash := prCommitHash(side); hash != "" {
+		candidates = append(candidates, hash)
+	}
+	if branch, ok := side["branch"].(map[string]any); ok {
+		if name, ok := branch["name"].(string); ok {
+			candidates = append(candidates, "refs/heads/"+name)
+		}
+	}
+	for _, candidate := range candidates {
+		output, err := runGit(repoFolder, "rev-parse", "--verify", "--quiet", candidate+"^{commit}")
+		if err == nil {
+			return strings.TrimSpace(output)
+		}
+	}
+	return ""
+}
+
+func (a *geiArchive) addPullRequest(pr PullRequest, comments []PRComment, repoFolder string) {
+	prURL := a.pullRequestURL(pr.ID)
+	headRef := pr.Source["branch"].(map[string]any)["name"].(string)
+	baseRef := pr.Destination["branch"].(map[string]any)["name"].(string)
+	var head, base string
+	if repoFolder != "" {
+		head = resolvePrCommit(repoFolder, pr.Source)
+		base = resolvePrCommit(repoFolder, pr.Destination)
+		if head != "" {
+			// Github keeps the head of every PR under refs/pull
+			_, err := runGit(repoFolder, "update-ref", fmt.Sprintf("refs/pull/%d/head", pr.ID), head)
+			if err != nil {
+				warn("Could not keep the head of the PR", "pr", pr.ID, "err", err)
+			}
+		}
+		if head != "" && base != "" {
+			// comments are on the diff against where the branch started
+			if mergeBase, err := runGit(repoFolder, "merge-base", base, head); err == nil {
+				base = strings.TrimSpace(mergeBase)
+			}
+		}
+	}
+	if head == "" {
+		warn("Could not find the commits of the PR, its diff can't be imported", "pr", pr.ID)
+	}
+
+	record := map[string]any{
+		"type":       "pull_request",
+		"url":        prURL,
+		"user":       a.user(pr.Author),
+		"repository": a.repoURL(),
+		"title":      pr.Title,
+		"body":       cleanBitbucketPRSummary(pr.Summary.Raw),
+		"base":       map[string]any{"ref": baseRef, "sha": base, "user": a.baseURL + "/" + a.owner, "repo": a.repoURL()},
+		"head":       map[string]any{"ref": headRef, "sha": head, "user": a.baseURL + "/" + a.owner, "repo": a.repoURL()},
+		"assignee":   nil,
+		"milestone":  nil,
+		"labels":     []any{},
+		"merged_at":  nil,
+		"closed_at":  nil,
+		"created_at": pr.CreatedOn.Format(geiTimeFormat),
+	}
+	if pr.State == "MERGED" {
+		// bitbucket doesn't say when a PR was merged, it was last updated by merging it
+		record["merged_at"] = pr.UpdatedOn.Format(geiTimeFormat)
+		record["closed_at"] = pr.UpdatedOn.Format(geiTimeFormat)
+	}
+	a.pullRequests = append(a.pullRequests, record)
+
+	reviewComments := map[int]string{}
+	for _, comment := range comments {
+		if comment.Deleted {
+			continue
+		}
+		commentURL := fmt.Sprintf("%s#issuecomment-%d", prURL, comment.ID)
+		if comment.Inline != nil && repoFolder != "" && head != "" {
+			filePath, _ := comment.Inline["path"].(string)
+			position, hunk, ok := diffPosition(repoFolder, base, head, filePath, comment.Inline)
+			if ok {
+				commentURL = fmt.Sprintf("%s#discussion_r%d", prURL, comment.ID)
+				reviewComments[comment.ID] = commentURL
+				var inReplyTo any
+				if parent, ok := toInt(comment.Parent["id"]); ok && reviewComments[parent] != "" {
+					inReplyTo = reviewComments[parent]
+				}
+				a.reviewComments = append(a.reviewComments, map[string]any{
+					"type":               "pull_request_review_comment",
+					"url":                commentURL,
+					"pull_request":       prURL,
+					"user":               a.user(comment.User),
+					"body":               comment.Content.Raw,
+					"formatter":          "markdown",
+					"diff_hunk":          hunk,
+					"path":               filePath,
+					"position":           position,
+					"original_position":  position,
+					"commit_id":          head,
+					"original_commit_id": head,
+					"state":              1,
+					"in_reply_to":        inReplyTo,
+					"reactions":          []any{},
+					"created_at":         comment.CreatedOn.Format(geiTimeFormat),
+				})
+				continue
+			}
+			slog.Debug("Inline comment is not on the diff of the PR, importing it as a PR comment", "pr", pr.ID, "comment", comment.ID)
+		}
+		a.issueComments = append(a.issueComments, map[string]any{
+			"type":         "issue_comment",
+			"url":          commentURL,
+			"pull_request": prURL,
+			"user":         a.user(comment.User),
+			"body":         comment.Content.Raw,
+			"formatter":    "markdown",
+			"reactions":    []any{},
+			"created_at":   comment.CreatedOn.Format(geiTimeFormat),
+		})
+	}
+}
+
+// json numbers decode as float64, the Data Center client builds ints
+func toInt(v any) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case float64:
+		return int(n), true
+	}
+	return 0, false
+}
+
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,\d+)? \+(\d+)(?:,\d+)? @@`)
+
+// finds the line an inline bitbucket comment is on in the diff of path between base and head.
+// Returns its position (lines below the first hunk header) and the hunk up to that line, like Github review comments have
+func diffPosition(repoFolder string, base string, head string, filePath string, inline map[string]any) (int, string, bool) {
+	// bitbucket anchors comments to a line of the new file, or the old one for removed lines
+	line, onNew := toInt(inline["to"])
+	if !onNew {
+		var ok bool
+		line, ok = toInt(inline["from"])
+		if !ok {
+			return 0, "", false
+		}
+	}
+	output, err := runGit(repoFolder, "diff", "--no-color", "--no-ext-diff", base, head, "--", filePath)
+	if err != nil {
+		return 0, "", false
+	}
+	lines := strings.Split(output, "\n")
+	position := 0
+	hunkStart := -1
+	var oldLine, newLine int
+	for i, text := range lines {
+		if match := hunkHeader.FindStringSubmatch(text); match != nil {
+			if hunkStart >= 0 {
+				position++
+			}
+			hunkStart = i
+			oldLine, _ = strconv.Atoi(match[1])
+			newLine, _ = strconv.Atoi(match[2])
+			continue
+		}
+		if hunkStart < 0 || text == "" {
+			continue
+		}
+		position++
+		found := false
+		switch text[0] {
+		case '+':
+			found = onNew && newLine == line
+			newLine++
+		case '-':
+			found = !onNew && oldLine == line
+			oldLine++
+		case ' ':
+			found = onNew && newLine == line
+			oldLine++
+			newLine++
+		}
+		if found {
+			return position, strings.Join(lines[hunkStart:i+1], "\n"), true
+		}
+	}
+	return 0, "", false
+}
+
+// writes the repo, its PRs and their comments as a ghe-migrator archive that Github's importers can restore
+// as real PRs with review threads
+func writeGeiArchive(archiveFile string, snapshot repoSnapshot, comments map[int][]PRComment, config settings) error {
+	a := &geiArchive{
+		baseURL:  config.ghBaseURL,
+		owner:    config.ghOwner,
+		repoName: snapshot.repo.Slug,
+		users:    map[string]map[string]any{},
+		// the importer expects every file, empty or not
+		pullRequests:   []map[string]any{},
+		reviewComments: []map[string]any{},
+		issueComments:  []map[string]any{},
+	}
+	if snapshot.prs != nil {
+		for _, pr := range snapshot.prs.Values {
+			a.addPullRequest(pr, comments[pr.ID], snapshot.folder)
+		}
+	}
+
+	exportedAt := time.Now()
+	gitURL := fmt.Sprintf("tarball://root/repositories/%s/%s.git", a.owner, a.repoName)
+	repository := map[string]any{
+		"type":           "repository",
+		"url":            a.repoURL(),
+		"owner":          a.baseURL + "/" + a.owner,
+		"name":           a.repoName,
+		"description":    snapshot.repo.Description,
+		"website":        nil,
+		"private":        snapshot.repo.Is_private,
+		"has_issues":     true,
+		"has_wiki":       false,
+		"has_downloads":  false,
+		"labels":         []any{},
+		"webhooks":       []any{},
+		"collaborators":  []any{},
+		"created_at":     exportedAt.Format(geiTimeFormat),
+		"git_url":        gitURL,
+		"default_branch": snapshot.repo.Mainbranch.Name,
+		"public_keys":    []any{},
+	}
+	if snapshot.folder == "" {
+		delete(repository, "git_url")
+	}
+	if snapshot.repo.CreatedOnTime != nil {
+		repository["created_at"] = snapshot.repo.CreatedOnTime.Format(geiTimeFormat)
+	}
+
+	users := []map[string]any{}
+	for _, user := range a.users {
+		users = append(users, user)
+	}
+
+	return createArchive(archiveFile, func(tw *tar.Writer) error {
+		for _, entry := range []struct {
+			name string
+			v    any
+		}{
+			{"schema.json", map[string]string{"version": geiSchemaVersion}},
+			{"urls.json", map[string]string{
+				"user":                        "{scheme}://{host}/{user}",
+				"organization":                "{scheme}://{host}/{organization}",
+				"repository":                  "{scheme}://{host}/{owner}/{repository}",
+				"pull_request":                "{scheme}://{host}/{owner}/{repository}/pull/{number}",
+				"pull_request_review_comment": "{scheme}://{host}/{owner}/{repository}/pull/{number}#discussion_r{pull_request_review_comment}",
+				"issue_comment":               "{scheme}://{host}/{owner}/{repository}/pull/{number}#issuecomment-{issue_comment}",
+			}},
+			{"users_000001.json", users},
+			{"repositories_000001.json", []any{repository}},
+			{"pull_requests_000001.json", a.pullRequests},
+			{"pull_request_review_comments_000001.json", a.reviewComments},
+			{"issue_comments_000001.json", a.issueComments},
+		} {
+			err := addJSONToArchive(tw, entry.name, entry.v, exportedAt)
+			if err != nil {
+				return err
+			}
+		}
+		if snapshot.folder == "" {
+			return nil
+		}
+		// work copies borrow their objects from the mirror, the archive needs its own
+		output, err := runGitLogged(snapshot.folder, "repack", "-a", "-d")
+		if err != nil {
+			return fmt.Errorf("failed to repack: %s: %s", err, output)
+		}
+		err = os.Remove(filepath.Join(snapshot.folder, "objects", "info", "alternates"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return addDirToArchive(tw, path.Join("repositories", a.owner, a.repoName+".git"), snapshot.folder)
+	})
+}
+
+// adds every file under dir to the archive under name
+func addDirToArchive(tw *tar.Writer, name string, dir string) error {
+	return filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		return addFileToArchive(tw, path.Join(name, filepath.ToSlash(rel)), file)
+	})
+}
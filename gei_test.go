@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGeiExport(t *testing.T) {
+	bb := newFakeBitbucket(t)
+	gh := newFakeGithub(t)
+	config := fakeSettings(t, bb, gh)
+	config.ghBaseURL = "https://github.com"
+	config.exportFormat = "gei"
+	seedBitbucketRepo(t, bb, config.bbWorkspace, "repo1")
+	bb.addPrComment(config.bbWorkspace, "repo1", 2, "Reviewer", "why wip?", map[string]any{"path": "feature.txt", "to": 1})
+	bb.addPrComment(config.bbWorkspace, "repo1", 2, "Reviewer", "looks good", nil)
+	dir := t.TempDir()
+
+	exportRepos(bb.client(), []string{"repo1"}, dir, config)
+
+	contents := t.TempDir()
+	err := extractArchive(geiArchivePath(dir, "repo1"), contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pulls, reviewComments, issueComments []map[string]any
+	for name, v := range map[string]any{
+		"pull_requests_000001.json":                &pulls,
+		"pull_request_review_comments_000001.json": &reviewComments,
+		"issue_comments_000001.json":               &issueComments,
+	} {
+		data, _ := os.ReadFile(filepath.Join(contents, name))
+		err := json.Unmarshal(data, v)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+	}
+	if len(pulls) != 2 || pulls[0]["merged_at"] == nil || pulls[1]["merged_at"] != nil {
+		t.Errorf("expected a merged and an open PR, got %v", pulls)
+	}
+	if pulls[1]["url"] != "https://github.com/org/repo1/pull/2" || pulls[1]["user"] != "https://github.com/Author-2" {
+		t.Errorf("unexpected PR urls %v", pulls[1])
+	}
+	if len(reviewComments) != 1 || reviewComments[0]["position"] != float64(1) || reviewComments[0]["diff_hunk"] != "@@ -0,0 +1 @@\n+wip" {
+		t.Errorf("unexpected review comments %v", reviewComments)
+	}
+	if len(issueComments) != 1 || issueComments[0]["body"] != "looks good" {
+		t.Errorf("unexpected PR comments %v", issueComments)
+	}
+
+	repo := filepath.Join(contents, "repositories", "org", "repo1.git")
+	head := testGit(t, repo, "rev-parse", "refs/pull/2/head")
+	if head != pulls[1]["head"].(map[string]any)["sha"] {
+		t.Errorf("expected refs/pull/2/head to be the head of the PR, got %s", head)
+	}
+	if _, err := os.Stat(filepath.Join(repo, "objects", "info", "alternates")); err == nil {
+		t.Error("expected the archived repo to have its own objects")
+	}
+	testGit(t, repo, "fsck")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// runs git with args in dir and returns the combined output
+func runGit(dir string, args ...string) (string, error) {
+	return runGitEnv(dir, nil, args...)
+}
+
+// like runGit with extra environment variables, for example to pass credentials
+func runGitEnv(dir string, env []string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+// parses "<sha> <ref>" lines (as printed by ls-remote and for-each-ref)
+// into a map of branch and tag refs to their SHA.
+// Peeled tag lines (ending in ^{}) and other refs are ignored
+func parseRefs(output string) map[string]string {
+	refs := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		sha, ref := fields[0], fields[1]
+		if strings.HasSuffix(ref, "^{}") {
+			continue
+		}
+		if strings.HasPrefix(ref, "refs/heads/") || strings.HasPrefix(ref, "refs/tags/") {
+			refs[ref] = sha
+		}
+	}
+	return refs
+}
+
+// lists branch and tag refs of a remote repo without cloning it
+func listRemoteRefs(remoteURL string, env []string) (map[string]string, error) {
+	output, err := runGitEnv("", env, "ls-remote", "--heads", "--tags", remoteURL)
+	if err != nil {
+		return nil, err
+	}
+	return parseRefs(output), nil
+}
+
+// lists branch and tag refs of a local repo
+func listLocalRefs(repoFolder string) (map[string]string, error) {
+	output, err := runGit(repoFolder, "for-each-ref", "--format=%(objectname) %(refname)", "refs/heads", "refs/tags")
+	if err != nil {
+		return nil, err
+	}
+	return parseRefs(output), nil
+}
+
+// reports whether ancestor is known in repoFolder and reachable from descendant
+func isAncestor(repoFolder string, ancestor string, descendant string) bool {
+	_, err := runGit(repoFolder, "merge-base", "--is-ancestor", ancestor, descendant)
+	return err == nil
+}
+
+// returns the size in bytes of all objects reachable from ref
+func refDiskUsage(repoFolder string, ref string) (int64, error) {
+	output, err := runGit(repoFolder, "rev-list", "--objects", "--disk-usage", ref)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+}
+
+// returns the size in bytes of the packed objects of a repo
+func repoSize(repoFolder string) (int64, error) {
+	output, err := runGit(repoFolder, "count-objects", "-v")
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, line := range strings.Split(output, "\n") {
+		// sizes are printed in KiB
+		for _, field := range []string{"size: ", "size-pack: "} {
+			if value, found := strings.CutPrefix(line, field); found {
+				kib, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+				if err != nil {
+					return 0, err
+				}
+				size += kib * 1024
+			}
+		}
+	}
+	return size, nil
+}
+
+// like runGit but logs the full output at debug level, so it ends up in the repo's log file
+func runGitLogged(dir string, args ...string) (string, error) {
+	return runGitLoggedEnv(dir, nil, args...)
+}
+
+// like runGitEnv but logs the full output at debug level
+func runGitLoggedEnv(dir string, env []string, args ...string) (string, error) {
+	output, err := runGitEnv(dir, env, args...)
+	slog.Debug("git output", "command", "git "+args[0], "output", output)
+	return output, err
+}
@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os/exec"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -13,19 +18,76 @@ import (
 	"github.com/ktrysmt/go-bitbucket"
 )
 
+const defaultGithubURL = "https://github.com"
+
+// GHE.com hosts its API on the api subdomain, Github Enterprise Server under /api/v3
+func githubAPIURL(baseURL string) (string, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("%q is not an absolute url", baseURL)
+	}
+	if isGheCom(baseURL) {
+		return fmt.Sprintf("%s://api.%s/", u.Scheme, u.Host), nil
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/", nil
+}
+
+// whether the base url is a GHE.com data residency tenant
+func isGheCom(baseURL string) bool {
+	u, err := url.Parse(baseURL)
+	return err == nil && strings.HasSuffix(u.Hostname(), ".ghe.com")
+}
+
+// the REST API url of the configured Github, with trailing slash
+func githubAPIBaseURL(config settings) (string, error) {
+	if config.ghBaseURL == defaultGithubURL {
+		return "https://api.github.com/", nil
+	}
+	return githubAPIURL(config.ghBaseURL)
+}
+
+func newGithubAPIClient(config settings, tokens githubTokenSource) (*github.Client, error) {
+	var client *github.Client
+	if app, ok := tokens.(*githubAppAuth); ok {
+		client = github.NewClient(&http.Client{Transport: app})
+	} else {
+		token, err := tokens.Token()
+		if err != nil {
+			return nil, err
+		}
+		client = github.NewClient(nil).WithAuthToken(token)
+	}
+	if config.ghBaseURL == defaultGithubURL {
+		return client, nil
+	}
+	apiURL, err := githubAPIURL(config.ghBaseURL)
+	if err != nil {
+		return nil, err
+	}
+	return client.WithEnterpriseURLs(apiURL, apiURL)
+}
+
 // replaces invalid chars in input that are not allowed in Github topics
 func cleanTopic(input string) string {
 	return strings.ReplaceAll(strings.ToLower(input), " ", "-")
 }
 
-func createRepo(gh *github.Client, repo *bitbucket.Repository, config settings) *github.Repository {
+// builds the Github repo that a bitbucket repo will be migrated to
+func newGithubRepo(repo *bitbucket.Repository, config settings) *github.Repository {
 	var visibility string
 	if repo.Is_private {
 		visibility = config.visibility
+	} else if isGheCom(config.ghBaseURL) {
+		// GHE.com enterprises are fully managed and don't allow public repos
+		warn("Public repo will not be public on GHE.com", "visibility", config.visibility)
+		visibility = config.visibility
 	} else {
 		visibility = "public"
 	}
-	ghRepo := &github.Repository{
+	return &github.Repository{
 		Name:          github.Ptr(repo.Slug),
 		Visibility:    github.Ptr(visibility),
 		Description:   github.Ptr(repo.Description),
@@ -36,61 +98,62 @@ func createRepo(gh *github.Client, repo *bitbucket.Repository, config settings)
 		},
 		Topics: []string{"migratedFromBitbucket", cleanTopic(repo.Project.Name)},
 	}
+}
 
+func createRepo(gh *githubClient, ghRepo *github.Repository, config settings) *github.Repository {
 	if config.dryRun {
 		return ghRepo
 	}
 
-	fmt.Printf("Creating repo %s/%s\n", config.ghOwner, repo.Slug)
+	repoName := *ghRepo.Name
+	slog.Info("Creating github repo", "github_repo", config.ghOwner+"/"+repoName)
 	_, _, err := gh.Repositories.Create(context.Background(), config.ghOrg, ghRepo)
 	if err != nil {
 		if strings.Contains(err.Error(), "name already exists on this account") {
 			if !config.overwrite {
-				log.Fatalf("Refusing to overwrite Github repo %s", repo.Slug)
+				fatalf("Refusing to overwrite Github repo %s", repoName)
 			}
 		} else {
-			log.Fatalf("failed to create repo %s, error: %s", repo.Slug, err)
+			fatalf("failed to create repo %s, error: %s", repoName, err)
 		}
+	} else {
+		journal.record(func(j *migrationJournal) { j.RepoCreated = true })
 	}
 
 	// The repository might not have been created yet
 	// Wait for the repository to be available
 	for i := 0; i < 20; i++ {
 		time.Sleep(200 * time.Millisecond)
-		response, _, _ := gh.Repositories.Get(context.Background(), config.ghOwner, repo.Slug)
+		response, _, _ := gh.Repositories.Get(context.Background(), config.ghOwner, repoName)
 		if response != nil {
-			fmt.Println("Repo has been created!")
+			slog.Info("Repo has been created")
 			return ghRepo
 		}
-		fmt.Printf("Waiting for repo %s to be available on GitHub (attempt %d)...", repo.Slug, i+1)
+		slog.Info("Waiting for repo to be available on GitHub", "attempt", i+1)
 		// Wait for a short period before retrying
 		time.Sleep(1 * time.Second)
 	}
-	log.Fatalf("Repo has still not been created")
+	fatalf("Repo has still not been created")
 	return nil
 }
 
-// you need to call this after createRepo and pushRepoToGithub because
+// you need to call this after createRepo and pushRepo because
 // topics can't be updated until the repository has contents
-func updateRepoTopics(gh *github.Client, githubOwner string, ghRepo *github.Repository, dryRun bool) {
+func updateRepoTopics(gh *githubClient, githubOwner string, ghRepo *github.Repository, dryRun bool) {
 	if dryRun {
-		fmt.Println("Mock updating repo topics")
+		slog.Info("Mock updating repo topics")
 		return
 	}
-	fmt.Printf("Updating repo %s/%s topics\n", githubOwner, *ghRepo.Name)
+	slog.Info("Updating repo topics", "topics", ghRepo.Topics)
 	_, _, err := gh.Repositories.ReplaceAllTopics(context.Background(), githubOwner, *ghRepo.Name, ghRepo.Topics)
 	if err != nil {
-		log.Fatalf("failed to update topics for repo %s, error: %s", *ghRepo.Name, err)
+		fatalf("failed to update topics for repo %s, error: %s", *ghRepo.Name, err)
 	}
 }
 
-func updateCustomProperties(gh *github.Client, githubOrg string, ghRepo *github.Repository, dryRun bool, projectName string) {
-	if githubOrg == "" {
-		// custom properties only works with organizations
-		// if no organization, we can't do anything
-		return
-	}
-	customProps := []*github.CustomPropertyValue{
+// custom properties set on every migrated repo
+func newCustomProperties(projectName string) []*github.CustomPropertyValue {
+	return []*github.CustomPropertyValue{
 		{
 			PropertyName: "bitbucket",
 			Value:        "true",
@@ -100,21 +163,29 @@ func updateCustomProperties(gh *github.Client, githubOrg string, ghRepo *github.
 			Value:        cleanTopic(projectName),
 		},
 	}
+}
+
+func updateCustomProperties(gh *githubClient, githubOrg string, ghRepo *github.Repository, dryRun bool, customProps []*github.CustomPropertyValue) {
+	if githubOrg == "" {
+		// custom properties only works with organizations
+		// if no organization, we can't do anything
+		return
+	}
 	if dryRun {
 		return
 	}
 	gh.Repositories.CreateOrUpdateCustomProperties(context.Background(), githubOrg, *ghRepo.Name, customProps)
 }
 
-func updateRepo(gh *github.Client, githubOwner string, ghRepo *github.Repository, dryRun bool) {
+func updateRepo(gh *githubClient, githubOwner string, ghRepo *github.Repository, dryRun bool) {
 	if dryRun {
-		fmt.Println("Mock updating repo default branch")
+		slog.Info("Mock updating repo default branch")
 		return
 	}
-	fmt.Printf("Updating repo %s/%s default branch\n", githubOwner, *ghRepo.Name)
+	slog.Info("Updating repo default branch", "branch", ghRepo.GetDefaultBranch())
 	_, _, err := gh.Repositories.Edit(context.Background(), githubOwner, *ghRepo.Name, ghRepo)
 	if err != nil {
-		log.Fatalf("failed to update repo %s, error: %s", *ghRepo.Name, err)
+		fatalf("failed to update repo %s, error: %s", *ghRepo.Name, err)
 	}
 }
 
@@ -125,46 +196,77 @@ func cleanBitbucketPRSummary(prSummary string) string {
 	return prSummary
 }
 
-// migrate open pull requests
-func migrateOpenPrs(gh *github.Client, githubOwner string, ghRepo *github.Repository, prs *PullRequests, dryRun bool) {
+// an open bitbucket PR rendered as a Github PR
+type plannedPullRequest struct {
+	BitbucketID int    `json:"bitbucketId"`
+	Title       string `json:"title"`
+	Body        string `json:"body"`
+	Head        string `json:"head"`
+	Base        string `json:"base"`
+	Draft       bool   `json:"draft"`
+	// the repo and branch the PR is from. PRs from forks have bitbucket-pr/<id> as head
+	SourceRepo   string `json:"sourceRepo"`
+	SourceBranch string `json:"sourceBranch"`
+	Fork         bool   `json:"fork"`
+	// the commit the PR is at, abbreviated like bitbucket returns it
+	SourceCommit string `json:"sourceCommit"`
+}
+
+// a merged bitbucket PR rendered as a closed Github issue
+type plannedIssue struct {
+	BitbucketID int      `json:"bitbucketId"`
+	Title       string   `json:"title"`
+	Body        string   `json:"body"`
+	Labels      []string `json:"labels"`
+	MergeCommit string   `json:"mergeCommit"`
+	// the commit the PR was merged from, abbreviated like bitbucket returns it
+	SourceCommit string `json:"sourceCommit"`
+	// the branch the PR was merged into
+	DestinationBranch string `json:"destinationBranch"`
+	// when the PR was created and merged, kept when issues are imported
+	CreatedAt time.Time `json:"createdAt"`
+	ClosedAt  time.Time `json:"closedAt"`
+}
+
+// renders the open bitbucket PRs as Github PRs against baseBranch
+func renderOpenPrs(prs *PullRequests, baseBranch string) []plannedPullRequest {
+	planned := []plannedPullRequest{}
 	for _, pr := range prs.Values {
 		if pr.State != "OPEN" {
 			continue
 		}
 		prID := strconv.Itoa(pr.ID)
 		prSummary := cleanBitbucketPRSummary(pr.Summary.Raw)
-		text := fmt.Sprintf("PR originally created by %s on %s. Migrated from bitbucket on %s\n\n---\n%s", pr.Author["display_name"].(string), pr.CreatedOn, time.Now().Format(time.RFC3339Nano), prSummary)
-		title := "Historical Bitbucket PR #" + prID + ": " + pr.Title
 		branch := pr.Source["branch"].(map[string]any)["name"].(string)
-		gh_pr := &github.NewPullRequest{
-			Title: &title,
-			Body:  &text,
-			Head:  &branch,
-			Base:  ghRepo.DefaultBranch,
-			Draft: &pr.Draft,
-		}
-		if dryRun {
-			return
+		fork := isForkPr(pr)
+		origin := ""
+		head := branch
+		if fork {
+			origin = fmt.Sprintf(" from branch %s of the fork %s", branch, prRepoFullName(pr.Source))
+			// a branch of the same name in the repo isn't the one the PR is from
+			head = prBranch(pr.ID)
 		}
-		newPr, _, err := gh.PullRequests.Create(context.Background(), githubOwner, *ghRepo.Name, gh_pr)
-		if err != nil {
-			if strings.Contains(err.Error(), "A pull request already exists") {
-				fmt.Printf("Skipping PR creation for PR %s, PR already exists\n", prID)
-			} else if strings.Contains(err.Error(), "422 Validation Failed [{Resource:PullRequest Field:head Code:invalid Message:}]") {
-				fmt.Printf("Could not make PR %s, originating branch %s likely no longer exists\n", prID, *gh_pr.Head)
-			} else {
-				log.Fatalf("failed to create PR %s, error: %s", prID, err)
-			}
-		} else {
-			fmt.Printf("Migrated BB PR %s as GH PR %d\n", prID, *newPr.Number)
-		}
-
-		time.Sleep(GitHubRateLimitSleep)
+		text := fmt.Sprintf("PR originally created by %s on %s%s. Migrated from bitbucket on %s\n\n---\n%s", pr.Author["display_name"].(string), pr.CreatedOn, origin, time.Now().Format(time.RFC3339Nano), prSummary)
+		title := "Historical Bitbucket PR #" + prID + ": " + pr.Title
+		planned = append(planned, plannedPullRequest{
+			BitbucketID:  pr.ID,
+			Title:        title,
+			Body:         text,
+			Head:         head,
+			Base:         baseBranch,
+			Draft:        pr.Draft,
+			SourceRepo:   prRepoFullName(pr.Source),
+			SourceBranch: branch,
+			Fork:         fork,
+			SourceCommit: prCommitHash(pr.Source),
+		})
 	}
+	return planned
 }
 
-// create pull requests
-func createClosedPrs(gh *github.Client, githubOwner string, ghRepo *github.Repository, prs *PullRequests, dryRun bool) {
+// renders the merged bitbucket PRs as closed Github issues
+func renderClosedPrs(prs *PullRequests) []plannedIssue {
+	planned := []plannedIssue{}
 	for _, pr := range prs.Values {
 		if pr.State != "MERGED" {
 			continue
@@ -175,45 +277,311 @@ func createClosedPrs(gh *github.Client, githubOwner string, ghRepo *github.Repos
 		branch := pr.Source["branch"].(map[string]interface{})["name"].(string)
 		mergedBy := pr.ClosedBy["display_name"].(string)
 		creationTime := pr.CreatedOn.Format(time.DateTime)
+		destination, _ := pr.Destination["branch"].(map[string]interface{})
+		destinationBranch, _ := destination["name"].(string)
 
 		title := fmt.Sprint("Historical Bitbucket PR #", pr.ID, ": ", pr.Title)
 		text := fmt.Sprint(
 			"**Bitbucket PR created from branch ", branch, " on ", creationTime, " by ", author,
 			". Merged by ", mergedBy, "**\n\n---\n", prSummary,
 		)
+		planned = append(planned, plannedIssue{
+			BitbucketID:       pr.ID,
+			Title:             title,
+			Body:              text,
+			Labels:            []string{"bitbucketPR"},
+			MergeCommit:       pr.MergeCommit.Hash,
+			SourceCommit:      prCommitHash(pr.Source),
+			DestinationBranch: destinationBranch,
+			CreatedAt:         pr.CreatedOn,
+			// bitbucket doesn't say when a PR was merged, it was last updated by merging it
+			ClosedAt: pr.UpdatedOn,
+		})
+	}
+	return planned
+}
+
+// creates the open PRs and returns the number of each PR it created by bitbucket id
+func createOpenPrs(gh *githubClient, githubOwner string, ghRepo *github.Repository, prs []plannedPullRequest, dryRun bool) map[int]int {
+	created := map[int]int{}
+	for _, pr := range prs {
+		prID := strconv.Itoa(pr.BitbucketID)
+		gh_pr := &github.NewPullRequest{
+			Title: github.Ptr(pr.Title),
+			Body:  github.Ptr(pr.Body),
+			Head:  github.Ptr(pr.Head),
+			Base:  github.Ptr(pr.Base),
+			Draft: github.Ptr(pr.Draft),
+		}
+		if dryRun {
+			slog.Info("Mock creating PR", "pr", pr.BitbucketID, "branch", pr.Head)
+			continue
+		}
+		var newPr *github.PullRequest
+		var err error
+		if fork := migratedFork(gh, githubOwner, ghRepo, pr); fork != "" {
+			fromFork := *gh_pr
+			fromFork.Head = github.Ptr(pr.SourceBranch)
+			fromFork.HeadRepo = github.Ptr(fork)
+			newPr, _, err = gh.PullRequests.Create(context.Background(), githubOwner, *ghRepo.Name, &fromFork)
+			if err != nil {
+				warn("Could not make PR from the migrated fork, using the imported branch", "pr", pr.BitbucketID, "fork", fork, "err", err)
+			}
+		}
+		if newPr == nil {
+			newPr, _, err = gh.PullRequests.Create(context.Background(), githubOwner, *ghRepo.Name, gh_pr)
+		}
+		if err != nil {
+			if strings.Contains(err.Error(), "A pull request already exists") {
+				warn("Skipping PR creation, PR already exists", "pr", pr.BitbucketID)
+			} else if strings.Contains(err.Error(), "422 Validation Failed [{Resource:PullRequest Field:head Code:invalid Message:}]") {
+				warn("Could not make PR, originating branch likely no longer exists", "pr", pr.BitbucketID, "branch", pr.Head)
+			} else {
+				fatalf("failed to create PR %s, error: %s", prID, err)
+			}
+		} else {
+			slog.Info("Migrated PR", "pr", pr.BitbucketID, "github_pr", newPr.GetNumber())
+			report.update(func(repo *repoReport) { repo.OpenPrsMigrated++ })
+			journal.record(func(j *migrationJournal) { j.PullRequests = append(j.PullRequests, newPr.GetNumber()) })
+			created[pr.BitbucketID] = newPr.GetNumber()
+		}
+
+		time.Sleep(GitHubRateLimitSleep)
+	}
+	return created
+}
+
+// returns the name of the Github fork of ghRepo that the fork pr is from was migrated to,
+// "" when pr isn't from a fork or the fork wasn't migrated as a fork of ghRepo
+func migratedFork(gh *githubClient, githubOwner string, ghRepo *github.Repository, pr plannedPullRequest) string {
+	if !pr.Fork {
+		return ""
+	}
+	_, name, _ := strings.Cut(pr.SourceRepo, "/")
+	fork, _, err := gh.Repositories.Get(context.Background(), githubOwner, name)
+	if err != nil || !strings.EqualFold(fork.GetParent().GetFullName(), githubOwner+"/"+ghRepo.GetName()) {
+		return ""
+	}
+	return fork.GetName()
+}
+
+// how long to wait between checks of an issue import, and how often to check before giving up on it
+var issueImportPollInterval = time.Second
+
+const issueImportMaxPolls = 300
 
+// creates closed issues for historical PRs and links them from their merge commits.
+// With useImport issues are imported with their original timestamps, falling back to creating them
+// when the issue import API isn't available
+func createIssues(gh *githubClient, githubOwner string, ghRepo *github.Repository, issues []plannedIssue, useImport bool, dryRun bool) {
+	for _, planned := range issues {
 		issue := &github.IssueRequest{
-			Title:  &title,
-			Body:   &text,
-			Labels: &[]string{"bitbucketPR"},
+			Title:  github.Ptr(planned.Title),
+			Body:   github.Ptr(planned.Body),
+			Labels: &planned.Labels,
 			State:  github.Ptr("closed"),
 		}
 		if dryRun {
-			return
+			slog.Info("Mock creating issue", "pr", planned.BitbucketID)
+			continue
 		}
-		fmt.Printf("Updating issue for PR %d\n", pr.ID)
-		issueResponse, _, err := gh.Issues.Create(context.Background(), githubOwner, *ghRepo.Name, issue)
-		if err != nil {
-			log.Fatalf("failed to create issue for PR %d, error: %s", pr.ID, err)
+		var issueResponse *github.Issue
+		if useImport {
+			slog.Info("Importing issue", "pr", planned.BitbucketID)
+			issueResponse = importIssue(gh, githubOwner, *ghRepo.Name, planned)
+			useImport = issueResponse != nil
+		}
+		imported := issueResponse != nil
+		if !imported {
+			slog.Info("Creating issue", "pr", planned.BitbucketID)
+			var err error
+			issueResponse, _, err = gh.Issues.Create(context.Background(), githubOwner, *ghRepo.Name, issue)
+			if err != nil {
+				fatalf("failed to create issue for PR %d, error: %s", planned.BitbucketID, err)
+			}
 		}
+		journal.record(func(j *migrationJournal) {
+			j.Issues = append(j.Issues, journalIssue{Number: issueResponse.GetNumber(), NodeID: issueResponse.GetNodeID()})
+		})
+		linkMergeCommit(gh, githubOwner, *ghRepo.Name, planned.MergeCommit, issueResponse.GetNumber())
 
-		commitHash := pr.MergeCommit.Hash
-		comment := &github.RepositoryComment{
-			Body: github.Ptr("Bitbucket PR details: #" + strconv.Itoa(*issueResponse.Number)),
+		if !imported {
+			// we can't create a closed issue directly so we have to edit the issue to close it
+			_, _, err := gh.Issues.Edit(context.Background(), githubOwner, *ghRepo.Name, *issueResponse.Number, issue)
+			if err != nil {
+				fatalf("failed to close issue %s: %s", *issueResponse.URL, err)
+			}
 		}
-		_, _, err = gh.Repositories.CreateComment(context.Background(), githubOwner, *ghRepo.Name, commitHash, comment)
+		report.update(func(repo *repoReport) { repo.IssuesCreated++ })
+
+		time.Sleep(GitHubRateLimitSleep)
+	}
+}
+
+// comments on the merge commit of a historical PR with a link to the issue or PR recording it
+func linkMergeCommit(gh *githubClient, githubOwner string, repo string, commitHash string, number int) {
+	comment := &github.RepositoryComment{
+		Body: github.Ptr("Bitbucket PR details: #" + strconv.Itoa(number)),
+	}
+	newComment, _, err := gh.Repositories.CreateComment(context.Background(), githubOwner, repo, commitHash, comment)
+	if err != nil {
+		fatalf("failed to comment on commit %s: %s", commitHash, err)
+	}
+	journal.record(func(j *migrationJournal) { j.Comments = append(j.Comments, newComment.GetID()) })
+}
+
+// recreates historical PRs as closed Github PRs, so their commits and diffs show up on Github.
+// PRs whose commits aren't on Github are recorded as issues instead
+func createClosedPrs(gh *githubClient, githubOwner string, ghRepo *github.Repository, issues []plannedIssue, useImport bool, dryRun bool) {
+	for _, planned := range issues {
+		if dryRun {
+			slog.Info("Mock creating closed PR", "pr", planned.BitbucketID)
+			continue
+		}
+		slog.Info("Creating closed PR", "pr", planned.BitbucketID)
+		pr, err := createClosedPr(gh, githubOwner, *ghRepo.Name, planned)
 		if err != nil {
-			log.Fatalf("failed to comment on commit %s: %s", commitHash, err)
+			fatalf("failed to recreate PR %d: %s", planned.BitbucketID, err)
 		}
+		if pr == nil {
+			createIssues(gh, githubOwner, ghRepo, []plannedIssue{planned}, useImport, dryRun)
+			continue
+		}
+		linkMergeCommit(gh, githubOwner, *ghRepo.Name, planned.MergeCommit, pr.GetNumber())
+		report.update(func(repo *repoReport) { repo.IssuesCreated++ })
 
-		// we can't create a closed issue directly so we have to edit the issue to close it
-		_, _, err = gh.Issues.Edit(context.Background(), githubOwner, *ghRepo.Name, *issueResponse.Number, issue)
+		time.Sleep(GitHubRateLimitSleep)
+	}
+}
+
+// opens a PR from the source commit of planned against the commit it was merged into, and closes it.
+// Both are pushed as temporary bitbucket-pr/<id> branches, which are deleted again before it returns,
+// also when it fails. Returns nil without an error when the PR can't be recreated
+func createClosedPr(gh *githubClient, owner string, repo string, planned plannedIssue) (*github.PullRequest, error) {
+	ctx := context.Background()
+	merge, _, err := gh.Repositories.GetCommit(ctx, owner, repo, planned.MergeCommit, nil)
+	if err != nil || len(merge.Parents) == 0 {
+		warn("Can't find the merge commit on Github, recording the PR as an issue", "pr", planned.BitbucketID, "commit", planned.MergeCommit, "err", err)
+		return nil, nil
+	}
+	// the merge commit has the changes of squash merged PRs, whose source commit often is gone
+	head := merge.GetSHA()
+	if planned.SourceCommit != "" {
+		source, _, err := gh.Repositories.GetCommit(ctx, owner, repo, planned.SourceCommit, nil)
+		if err == nil {
+			head = source.GetSHA()
+		}
+	}
+	base := merge.Parents[0].GetSHA()
+
+	headBranch := prBranch(planned.BitbucketID)
+	baseBranch := headBranch + "-base"
+	branches := []string{}
+	defer func() {
+		for _, branch := range branches {
+			_, err := gh.Git.DeleteRef(ctx, owner, repo, "heads/"+branch)
+			if err != nil {
+				warn("Failed to delete temporary branch", "branch", branch, "err", err)
+			}
+		}
+	}()
+	for _, branch := range []struct{ name, sha string }{{headBranch, head}, {baseBranch, base}} {
+		ref := &github.Reference{Ref: github.Ptr("refs/heads/" + branch.name), Object: &github.GitObject{SHA: github.Ptr(branch.sha)}}
+		_, _, err := gh.Git.CreateRef(ctx, owner, repo, ref)
+		if err != nil {
+			// left behind by a run that was killed, the branches are btg's own
+			_, _, err = gh.Git.UpdateRef(ctx, owner, repo, ref, true)
+		}
 		if err != nil {
-			log.Fatalf("failed to close issue %s: %s", *issueResponse.URL, err)
+			return nil, fmt.Errorf("failed to push branch %s: %w", branch.name, err)
 		}
+		branches = append(branches, branch.name)
+	}
 
-		time.Sleep(GitHubRateLimitSleep)
+	// Github only opens PRs against branches, so the PR is opened against the commit it was merged into
+	// on a branch of its own, which is gone once the PR is closed
+	body := planned.Body
+	if planned.DestinationBranch != "" {
+		body = fmt.Sprintf("**Merged into %s. The base branch %s was only created to recreate the PR on Github**\n\n%s",
+			planned.DestinationBranch, baseBranch, body)
+	}
+	pr, _, err := gh.PullRequests.Create(ctx, owner, repo, &github.NewPullRequest{
+		Title: github.Ptr(planned.Title),
+		Body:  github.Ptr(body),
+		Head:  github.Ptr(headBranch),
+		Base:  github.Ptr(baseBranch),
+	})
+	if err != nil {
+		warn("Failed to recreate PR, recording it as an issue", "pr", planned.BitbucketID, "err", err)
+		return nil, nil
+	}
+	journal.record(func(j *migrationJournal) { j.PullRequests = append(j.PullRequests, pr.GetNumber()) })
+	// closed before its branches are deleted, deleting them would close it without saying so
+	_, _, err = gh.PullRequests.Edit(ctx, owner, repo, pr.GetNumber(), &github.PullRequest{State: github.Ptr("closed")})
+	if err != nil {
+		return nil, fmt.Errorf("failed to close PR #%d: %w", pr.GetNumber(), err)
+	}
+	_, _, err = gh.Issues.AddLabelsToIssue(ctx, owner, repo, pr.GetNumber(), planned.Labels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to label PR #%d: %w", pr.GetNumber(), err)
+	}
+	slog.Info("Created closed PR", "pr", planned.BitbucketID, "github_pr", pr.GetNumber())
+	return pr, nil
+}
+
+// imports planned as a closed issue with its original timestamps and waits for the import to finish.
+// Returns nil when the issue import API isn't available
+func importIssue(gh *githubClient, owner string, repo string, planned plannedIssue) *github.Issue {
+	ctx := context.Background()
+	request := &github.IssueImportRequest{
+		IssueImport: github.IssueImport{
+			Title:     planned.Title,
+			Body:      planned.Body,
+			CreatedAt: &github.Timestamp{Time: planned.CreatedAt},
+			UpdatedAt: &github.Timestamp{Time: planned.ClosedAt},
+			ClosedAt:  &github.Timestamp{Time: planned.ClosedAt},
+			Closed:    github.Ptr(true),
+			Labels:    planned.Labels,
+		},
+	}
+	status, err := gh.IssueImport.Create(ctx, owner, repo, request)
+	var errResponse *github.ErrorResponse
+	if errors.As(err, &errResponse) && slices.Contains([]int{http.StatusNotFound, http.StatusGone}, errResponse.Response.StatusCode) {
+		warn("The issue import API isn't available, creating issues instead", "err", err)
+		return nil
+	}
+	if err != nil {
+		fatalf("failed to import issue for PR %d, error: %s", planned.BitbucketID, err)
 	}
+	for polls := 0; status.Status == "pending"; polls++ {
+		if polls == issueImportMaxPolls {
+			// creating the issue instead could duplicate it when the import finishes after all
+			fatalf("import %d of issue for PR %d is still pending after %s, check it on Github before running again",
+				status.ID, planned.BitbucketID, issueImportPollInterval*issueImportMaxPolls)
+		}
+		time.Sleep(issueImportPollInterval)
+		status, err = gh.IssueImport.CheckStatus(ctx, owner, repo, status.ID)
+		if err != nil {
+			fatalf("failed to check import of issue for PR %d, error: %s", planned.BitbucketID, err)
+		}
+	}
+	if status.Status != "imported" {
+		details := []string{}
+		for _, e := range status.Errors {
+			details = append(details, fmt.Sprintf("%s %s: %s", e.GetResource(), e.GetField(), e.GetCode()))
+		}
+		fatalf("failed to import issue for PR %d, status %s: %s", planned.BitbucketID, status.Status, strings.Join(details, ", "))
+	}
+	number, err := strconv.Atoi(path.Base(status.IssueURL))
+	if err != nil {
+		fatalf("failed to import issue for PR %d, unexpected issue url %q", planned.BitbucketID, status.IssueURL)
+	}
+	issue, _, err := gh.Issues.Get(ctx, owner, repo, number)
+	if err != nil {
+		fatalf("failed to get imported issue #%d, error: %s", number, err)
+	}
+	slog.Info("Imported issue", "pr", planned.BitbucketID, "github_issue", number)
+	return issue
 }
 
 func runProgram(repoFolder string, program string) ([]byte, error) {
@@ -225,36 +593,91 @@ func runProgram(repoFolder string, program string) ([]byte, error) {
 	}
 }
 
-// pushes all repo branches&tags to Github with --mirror option.
+func githubRepoURL(repoName string, config settings) string {
+	return fmt.Sprintf("%s/%s/%s.git", config.ghBaseURL, config.ghOwner, repoName)
+}
+
+// the ssh url of the repo on the configured Github
+func githubSSHURL(repoName string, config settings) string {
+	u, err := url.Parse(config.ghBaseURL)
+	if err != nil {
+		fatalf("GITHUB_BASE_URL is not a valid url: %s", err)
+	}
+	return fmt.Sprintf("git@%s:%s/%s.git", u.Hostname(), config.ghOwner, repoName)
+}
+
+// adds the pushed refs and repo size to the report
+func recordPush(repoFolder string) {
+	refs, err := listLocalRefs(repoFolder)
+	if err != nil {
+		fatalf("Failed to list refs: %s", err)
+	}
+	size, err := repoSize(repoFolder)
+	if err != nil {
+		fatalf("Failed to get repo size: %s", err)
+	}
+	report.update(func(repo *repoReport) {
+		repo.RefsPushed = len(refs)
+		repo.SizeBytes = size
+	})
+}
+
+// pushes all repo branches&tags to the target with --mirror option.
 // default branch may get updated as a side-effect
-func pushRepoToGithub(repoFolder string, repoName string, config settings) {
+func pushRepo(repoFolder string, repoName string, target migrationTarget, missingLfsObjects []string, config settings) {
 	const newOrigin string = "newOrigin"
 
-	cmd := exec.Command("git", "remote", "add", newOrigin, fmt.Sprintf("https://github.com/%s/%s.git", config.ghOwner, repoName))
-	cmd.Dir = repoFolder
-	output, err := cmd.CombinedOutput()
-	fmt.Print(string(output))
+	remoteURL, env := target.gitRemote(repoName)
+	output, err := runGitLogged(repoFolder, "remote", "add", newOrigin, remoteURL)
 	if err != nil {
-		log.Fatalf("Failed to add new git origin: %s\nOutput: %s", err, string(output))
+		fatalf("Failed to add new git origin: %s\nOutput: %s", err, output)
 	}
 
-	output, err = runProgram(repoFolder, config.runProgram)
-	fmt.Print(string(output))
+	programOutput, err := runProgram(repoFolder, config.runProgram)
+	slog.Debug("custom program output", "program", config.runProgram, "output", string(programOutput))
 	if err != nil {
-		log.Fatalf("Failed to run custom program %s. err: %s", config.runProgram, err)
+		fatalf("Failed to run custom program %s. err: %s", config.runProgram, err)
+	}
+
+	preflightLargeFiles(repoFolder, config)
+
+	var lfsObjects map[string]int64
+	if config.migrateLfs || config.largeFileAction == "lfs" {
+		lfsObjects, err = findLfsObjects(repoFolder)
+		if err != nil {
+			fatalf("Failed to scan repo for LFS pointers: %s", err)
+		}
+		if len(lfsObjects) > 0 {
+			slog.Info("Repo uses LFS, objects will be copied to "+target.name()+" LFS storage", "lfs_objects", len(lfsObjects), "lfs_bytes", lfsTotalSize(lfsObjects))
+		}
 	}
 
 	if config.dryRun {
 		return
 	}
 
-	fmt.Println("Pushing repo", repoName, "to github")
+	if len(lfsObjects) > 0 {
+		// LFS objects have to be on the target before the refs pointing to them
+		pushLfsObjects(repoFolder, newOrigin, env)
+	}
+
+	slog.Info("Pushing repo to " + target.name())
 
-	cmd = exec.Command("git", "push", newOrigin, "--mirror")
-	cmd.Dir = repoFolder
-	output, err = cmd.CombinedOutput()
+	output, err = runGitLoggedEnv(repoFolder, env, "push", newOrigin, "--mirror")
 	if err != nil {
-		log.Fatalf("Failed to push: %s\nOutput: %s", err, string(output))
+		fatalf("Failed to push: %s\nOutput: %s", err, output)
+	}
+	recordPush(repoFolder)
+
+	if len(lfsObjects) > 0 {
+		unresolved, err := verifyLfsObjects(target, repoName, lfsObjects)
+		if err != nil {
+			fatalf("Failed to verify LFS objects on %s: %s", target.name(), err)
+		}
+		unresolved = slices.DeleteFunc(unresolved, func(oid string) bool { return slices.Contains(missingLfsObjects, oid) })
+		if len(unresolved) > 0 {
+			fatalf("%d LFS pointers do not resolve on %s: %v", len(unresolved), target.name(), unresolved)
+		}
+		slog.Info("Verified every LFS pointer resolves on " + target.name())
 	}
-	fmt.Print(string(output))
 }
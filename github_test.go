@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ktrysmt/go-bitbucket"
+)
+
+func TestGithubAPIURL(t *testing.T) {
+	for baseURL, want := range map[string]string{
+		"https://github.example.com":  "https://github.example.com/",
+		"https://github.example.com/": "https://github.example.com/",
+		"https://acme.ghe.com":        "https://api.acme.ghe.com/",
+	} {
+		got, err := githubAPIURL(baseURL)
+		if err != nil || got != want {
+			t.Errorf("githubAPIURL(%q) = %q, %v, expected %q", baseURL, got, err, want)
+		}
+	}
+	if _, err := githubAPIURL("github.example.com"); err == nil {
+		t.Error("expected an error for a url without scheme")
+	}
+}
+
+func TestNewGithubRepoVisibility(t *testing.T) {
+	public := &bitbucket.Repository{Slug: "repo1", Is_private: false}
+	config := settings{visibility: "internal", ghBaseURL: defaultGithubURL}
+	if got := newGithubRepo(public, config).GetVisibility(); got != "public" {
+		t.Errorf("expected public on github.com, got %s", got)
+	}
+	config.ghBaseURL = "https://acme.ghe.com"
+	if got := newGithubRepo(public, config).GetVisibility(); got != "internal" {
+		t.Errorf("expected internal on GHE.com, got %s", got)
+	}
+}
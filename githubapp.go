@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// installation tokens are valid for an hour, refresh them well before that
+const githubAppTokenRefreshMargin = 5 * time.Minute
+
+// hands out Github tokens for API calls, git pushes and LFS
+type githubTokenSource interface {
+	Token() (string, error)
+}
+
+// a personal access token
+type staticToken string
+
+func (t staticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+// authenticates as an installation of a Github App.
+// see https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/authenticating-as-a-github-app-installation
+type githubAppAuth struct {
+	appID          int64
+	key            *rsa.PrivateKey
+	installationID int64
+	apiURL         string // with trailing slash
+	client         *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func newGithubAppAuth(appID int64, keyFile string, installationID int64, apiURL string) (*githubAppAuth, error) {
+	pemBytes, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseRSAPrivateKey(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %w", keyFile, err)
+	}
+	return &githubAppAuth{
+		appID:          appID,
+		key:            key,
+		installationID: installationID,
+		apiURL:         apiURL,
+		client:         &http.Client{},
+	}, nil
+}
+
+// Github generates PKCS#1 keys, but accept PKCS#8 too in case the key was converted
+func parseRSAPrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// returns a JWT signed with the app's private key, valid for 9 minutes
+func (a *githubAppAuth) jwt(now time.Time) (string, error) {
+	encode := func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data), err
+	}
+	header, err := encode(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := encode(map[string]any{
+		// backdated to allow for clock drift
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.FormatInt(a.appID, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(header + "." + claims))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return header + "." + claims + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// calls the Github API as the app itself
+func (a *githubAppAuth) appRequest(method string, path string, result any) error {
+	jwt, err := a.jwt(time.Now())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, a.apiURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// looks up the installation of the app on the org or user when no installation id is configured
+func (a *githubAppAuth) findInstallation(owner string, isOrg bool) error {
+	if a.installationID != 0 {
+		return nil
+	}
+	path := "users/" + owner + "/installation"
+	if isOrg {
+		path = "orgs/" + owner + "/installation"
+	}
+	var installation struct {
+		ID int64 `json:"id"`
+	}
+	err := a.appRequest("GET", path, &installation)
+	if err != nil {
+		return fmt.Errorf("failed to find installation of app %d on %s, is the app installed? %w", a.appID, owner, err)
+	}
+	a.installationID = installation.ID
+	return nil
+}
+
+// returns the current installation token, creating a new one when it is about to expire
+func (a *githubAppAuth) Token() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Until(a.expiresAt) > githubAppTokenRefreshMargin {
+		return a.token, nil
+	}
+	var result struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	err := a.appRequest("POST", fmt.Sprintf("app/installations/%d/access_tokens", a.installationID), &result)
+	if err != nil {
+		return "", fmt.Errorf("failed to create installation token: %w", err)
+	}
+	a.token = result.Token
+	a.expiresAt = result.ExpiresAt
+	return a.token, nil
+}
+
+// adds the installation token to every API request
+func (a *githubAppAuth) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := a.Token()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultTransport.RoundTrip(req)
+}
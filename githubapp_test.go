@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGithubAppAuth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "app.pem")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600)
+
+	tokensIssued := 0
+	// the first token is about to expire so it has to be refreshed right away
+	expiries := []time.Duration{time.Minute, time.Hour}
+	mux := http.NewServeMux()
+	verifyJWT := func(w http.ResponseWriter, r *http.Request) bool {
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		if len(parts) != 3 {
+			http.Error(w, "not a jwt", http.StatusUnauthorized)
+			return false
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature) != nil {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+	mux.HandleFunc("GET /orgs/org/installation", func(w http.ResponseWriter, r *http.Request) {
+		if verifyJWT(w, r) {
+			writeJSON(w, http.StatusOK, map[string]any{"id": 7})
+		}
+	})
+	mux.HandleFunc("POST /app/installations/7/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		if verifyJWT(w, r) {
+			writeJSON(w, http.StatusCreated, map[string]any{
+				"token":      fmt.Sprintf("token-%d", tokensIssued),
+				"expires_at": time.Now().Add(expiries[tokensIssued]),
+			})
+			tokensIssued++
+		}
+	})
+	mux.HandleFunc("GET /echo", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	app, err := newGithubAppAuth(123, keyFile, 0, server.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.findInstallation("org", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"token-0", "token-1", "token-1"} {
+		token, err := app.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != want {
+			t.Errorf("expected %s, got %s", want, token)
+		}
+	}
+
+	resp, err := (&http.Client{Transport: app}).Get(server.URL + "/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	header := make([]byte, 64)
+	n, _ := resp.Body.Read(header)
+	if got := string(header[:n]); got != "Bearer token-1" {
+		t.Errorf("expected the installation token to be sent, got %q", got)
+	}
+}
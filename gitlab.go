@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v72/github"
+)
+
+const defaultGitlabURL = "https://gitlab.com"
+
+// talks to the GitLab REST API v4
+type gitlabAPI struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+type gitlabError struct {
+	status  int
+	message string
+}
+
+func (e *gitlabError) Error() string {
+	return fmt.Sprintf("%d %s", e.status, e.message)
+}
+
+func newGitlabAPI(baseURL string, token string) *gitlabAPI {
+	return &gitlabAPI{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		client:  http.DefaultClient,
+	}
+}
+
+func (api *gitlabAPI) do(method string, path string, body any, result any) error {
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, api.baseURL+"/api/v4"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("PRIVATE-TOKEN", api.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := api.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		// message is a string, a list or a map of field to errors depending on the endpoint
+		var glErr struct {
+			Message any `json:"message"`
+			Error   any `json:"error"`
+		}
+		json.Unmarshal(respBody, &glErr)
+		message := fmt.Sprint(glErr.Message)
+		if glErr.Message == nil {
+			message = fmt.Sprint(glErr.Error)
+		}
+		return &gitlabError{status: resp.StatusCode, message: message}
+	}
+	if result == nil || len(bytes.TrimSpace(respBody)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, result)
+}
+
+type gitlabTarget struct {
+	api    *gitlabAPI
+	config settings
+}
+
+func newGitlabTarget(api *gitlabAPI, config settings) *gitlabTarget {
+	return &gitlabTarget{api: api, config: config}
+}
+
+// projects can be referenced by their url encoded full path instead of their id
+func (t *gitlabTarget) projectPath(repo *github.Repository) string {
+	return "/projects/" + url.PathEscape(t.config.glGroup+"/"+repo.GetName())
+}
+
+func (t *gitlabTarget) name() string {
+	return "GitLab"
+}
+
+func (t *gitlabTarget) createRepo(repo *github.Repository) *github.Repository {
+	if t.config.dryRun {
+		return repo
+	}
+	repoName := repo.GetName()
+	slog.Info("Creating gitlab project", "gitlab_project", t.config.glGroup+"/"+repoName)
+	var group struct {
+		ID int `json:"id"`
+	}
+	err := t.api.do("GET", "/groups/"+url.PathEscape(t.config.glGroup), nil, &group)
+	if err != nil {
+		fatalf("Failed to get gitlab group %s: %s", t.config.glGroup, err)
+	}
+	err = t.api.do("POST", "/projects", map[string]any{
+		"name":         repoName,
+		"path":         repoName,
+		"namespace_id": group.ID,
+		"description":  repo.GetDescription(),
+		"visibility":   repo.GetVisibility(),
+	}, nil)
+	if err != nil {
+		if strings.Contains(err.Error(), "has already been taken") {
+			if !t.config.overwrite {
+				fatalf("Refusing to overwrite GitLab project %s", repoName)
+			}
+		} else {
+			fatalf("failed to create project %s, error: %s", repoName, err)
+		}
+	}
+	return repo
+}
+
+func (t *gitlabTarget) repoURL(repoName string) string {
+	return fmt.Sprintf("%s/%s/%s.git", t.config.glURL, t.config.glGroup, repoName)
+}
+
+func (t *gitlabTarget) lfsCredentials() (string, string) {
+	return "oauth2", t.config.glToken
+}
+
+func (t *gitlabTarget) gitRemote(repoName string) (string, []string) {
+	return t.repoURL(repoName), gitCredentialEnv(t.lfsCredentials())
+}
+
+func (t *gitlabTarget) updateSettings(repo *github.Repository, customProps []*github.CustomPropertyValue) {
+	if t.config.dryRun {
+		slog.Info("Mock updating project default branch and topics")
+		return
+	}
+	slog.Info("Updating project default branch and topics", "branch", repo.GetDefaultBranch(), "topics", repo.Topics)
+	err := t.api.do("PUT", t.projectPath(repo), map[string]any{
+		"default_branch": repo.GetDefaultBranch(),
+		"topics":         repo.Topics,
+	}, nil)
+	if err != nil {
+		fatalf("failed to update project %s, error: %s", repo.GetName(), err)
+	}
+	// GitLab has no custom properties
+}
+
+func (t *gitlabTarget) createPullRequests(repo *github.Repository, prs []plannedPullRequest) map[int]int {
+	created := map[int]int{}
+	for _, pr := range prs {
+		title := pr.Title
+		if pr.Draft {
+			title = "Draft: " + title
+		}
+		if t.config.dryRun {
+			slog.Info("Mock creating merge request", "pr", pr.BitbucketID, "branch", pr.Head)
+			continue
+		}
+		var mr struct {
+			IID int `json:"iid"`
+		}
+		err := t.api.do("POST", t.projectPath(repo)+"/merge_requests", map[string]any{
+			"source_branch": pr.Head,
+			"target_branch": pr.Base,
+			"title":         title,
+			"description":   pr.Body,
+		}, &mr)
+		if err != nil {
+			if strings.Contains(err.Error(), "merge request already exists") {
+				warn("Skipping merge request creation, merge request already exists", "pr", pr.BitbucketID)
+			} else if strings.Contains(err.Error(), "does not exist") {
+				warn("Could not make merge request, originating branch likely no longer exists", "pr", pr.BitbucketID, "branch", pr.Head)
+			} else {
+				fatalf("failed to create merge request for PR %d, error: %s", pr.BitbucketID, err)
+			}
+		} else {
+			slog.Info("Migrated PR", "pr", pr.BitbucketID, "gitlab_mr", mr.IID)
+			report.update(func(repo *repoReport) { repo.OpenPrsMigrated++ })
+			created[pr.BitbucketID] = mr.IID
+		}
+
+		time.Sleep(GitHubRateLimitSleep)
+	}
+	return created
+}
+
+func (t *gitlabTarget) closePullRequest(repo *github.Repository, number int) {
+	if t.config.dryRun {
+		slog.Info("Mock closing merge request", "gitlab_mr", number)
+		return
+	}
+	err := t.api.do("PUT", fmt.Sprintf("%s/merge_requests/%d", t.projectPath(repo), number), map[string]any{"state_event": "close"}, nil)
+	if err != nil {
+		fatalf("failed to close merge request !%d: %s", number, err)
+	}
+	slog.Info("Closed merge request", "gitlab_mr", number)
+}
+
+func (t *gitlabTarget) createHistoricalRecords(repo *github.Repository, issues []plannedIssue) {
+	for _, planned := range issues {
+		if t.config.dryRun {
+			slog.Info("Mock creating issue", "pr", planned.BitbucketID)
+			continue
+		}
+		slog.Info("Creating issue", "pr", planned.BitbucketID)
+		var issue struct {
+			IID    int    `json:"iid"`
+			WebURL string `json:"web_url"`
+		}
+		err := t.api.do("POST", t.projectPath(repo)+"/issues", map[string]any{
+			"title":       planned.Title,
+			"description": planned.Body,
+			"labels":      strings.Join(planned.Labels, ","),
+		}, &issue)
+		if err != nil {
+			fatalf("failed to create issue for PR %d, error: %s", planned.BitbucketID, err)
+		}
+
+		commitHash := planned.MergeCommit
+		err = t.api.do("POST", t.projectPath(repo)+"/repository/commits/"+commitHash+"/comments", map[string]any{
+			"note": "Bitbucket PR details: #" + strconv.Itoa(issue.IID),
+		}, nil)
+		if err != nil {
+			fatalf("failed to comment on commit %s: %s", commitHash, err)
+		}
+
+		err = t.api.do("PUT", fmt.Sprintf("%s/issues/%d", t.projectPath(repo), issue.IID), map[string]any{
+			"state_event": "close",
+		}, nil)
+		if err != nil {
+			fatalf("failed to close issue %s: %s", issue.WebURL, err)
+		}
+		report.update(func(repo *repoReport) { repo.IssuesCreated++ })
+
+		time.Sleep(GitHubRateLimitSleep)
+	}
+}
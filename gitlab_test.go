@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+// an in process GitLab API, creating a project also creates a bare git repo
+// under gitDir/<group>/<name>.git to push to
+type fakeGitlab struct {
+	mu       sync.Mutex
+	server   *httptest.Server
+	gitDir   string
+	projects map[string]*fakeGitlabProject // keyed by full path
+}
+
+type fakeGitlabProject struct {
+	settings map[string]any
+	mrs      []map[string]any
+	issues   []map[string]any
+	comments map[string][]string // commit sha to notes
+	nextIID  int
+}
+
+func newFakeGitlab(t *testing.T) *fakeGitlab {
+	f := &fakeGitlab{gitDir: t.TempDir(), projects: map[string]*fakeGitlabProject{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v4/groups/{group}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"id": 42, "full_path": r.PathValue("group")})
+	})
+	mux.HandleFunc("POST /api/v4/projects", f.createProject)
+	mux.HandleFunc("PUT /api/v4/projects/{id}", f.withProject(f.updateProject))
+	mux.HandleFunc("POST /api/v4/projects/{id}/merge_requests", f.withProject(f.createMergeRequest))
+	mux.HandleFunc("POST /api/v4/projects/{id}/issues", f.withProject(f.createIssue))
+	mux.HandleFunc("PUT /api/v4/projects/{id}/issues/{iid}", f.withProject(f.updateIssue))
+	mux.HandleFunc("POST /api/v4/projects/{id}/repository/commits/{sha}/comments", f.withProject(f.createComment))
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeGitlab) withProject(handler func(w http.ResponseWriter, r *http.Request, project *fakeGitlabProject, body map[string]any)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		// the id is the url encoded full path of the project
+		project, ok := f.projects[r.PathValue("id")]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]any{"message": "404 Project Not Found"})
+			return
+		}
+		handler(w, r, project, body)
+	}
+}
+
+func (f *fakeGitlab) createProject(w http.ResponseWriter, r *http.Request) {
+	var body map[string]any
+	json.NewDecoder(r.Body).Decode(&body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := "group/" + body["path"].(string)
+	if _, exists := f.projects[path]; exists {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"message": map[string]any{"path": []string{"has already been taken"}}})
+		return
+	}
+	output, err := runGit("", "init", "--bare", filepath.Join(f.gitDir, path+".git"))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"message": output})
+		return
+	}
+	f.projects[path] = &fakeGitlabProject{settings: body, comments: map[string][]string{}, nextIID: 1}
+	writeJSON(w, http.StatusCreated, map[string]any{"id": len(f.projects), "path_with_namespace": path})
+}
+
+func (f *fakeGitlab) updateProject(w http.ResponseWriter, r *http.Request, project *fakeGitlabProject, body map[string]any) {
+	for key, value := range body {
+		project.settings[key] = value
+	}
+	writeJSON(w, http.StatusOK, project.settings)
+}
+
+func (f *fakeGitlab) createMergeRequest(w http.ResponseWriter, r *http.Request, project *fakeGitlabProject, body map[string]any) {
+	_, err := runGit(filepath.Join(f.gitDir, r.PathValue("id")+".git"), "rev-parse", "--verify", "refs/heads/"+body["source_branch"].(string))
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]any{"message": []string{"Source branch does not exist"}})
+		return
+	}
+	body["iid"] = project.nextIID
+	project.nextIID++
+	project.mrs = append(project.mrs, body)
+	writeJSON(w, http.StatusCreated, body)
+}
+
+func (f *fakeGitlab) createIssue(w http.ResponseWriter, r *http.Request, project *fakeGitlabProject, body map[string]any) {
+	body["iid"] = project.nextIID
+	body["state"] = "opened"
+	project.nextIID++
+	project.issues = append(project.issues, body)
+	writeJSON(w, http.StatusCreated, body)
+}
+
+func (f *fakeGitlab) updateIssue(w http.ResponseWriter, r *http.Request, project *fakeGitlabProject, body map[string]any) {
+	iid, _ := strconv.Atoi(r.PathValue("iid"))
+	for _, issue := range project.issues {
+		if issue["iid"] == iid {
+			if body["state_event"] == "close" {
+				issue["state"] = "closed"
+			}
+			writeJSON(w, http.StatusOK, issue)
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]any{"message": "404 Issue Not Found"})
+}
+
+func (f *fakeGitlab) createComment(w http.ResponseWriter, r *http.Request, project *fakeGitlabProject, body map[string]any) {
+	project.comments[r.PathValue("sha")] = append(project.comments[r.PathValue("sha")], body["note"].(string))
+	writeJSON(w, http.StatusCreated, body)
+}
+
+func TestMigrateRepoToGitlab(t *testing.T) {
+	bb := newFakeBitbucket(t)
+	gl := newFakeGitlab(t)
+	config := fakeSettings(t, bb, newFakeGithub(t))
+	config.target = "gitlab"
+	config.glURL = gl.gitDir
+	config.glGroup = "group"
+	config.glToken = "token"
+	config.ghOwner = "group"
+	mergeCommit := seedBitbucketRepo(t, bb, config.bbWorkspace, "repo1")
+
+	migrateRepo(newGitlabTarget(newGitlabAPI(gl.server.URL, config.glToken), config), bb.client(), "repo1", config)
+
+	project := gl.projects["group/repo1"]
+	if project == nil {
+		t.Fatal("project was not created on gitlab")
+	}
+	if diff := deep.Equal(testGit(t, filepath.Join(gl.gitDir, "group/repo1.git"), "rev-parse", "feature"),
+		testGit(t, filepath.Join(bb.gitDir, "workspace/repo1.git"), "rev-parse", "feature")); diff != nil {
+		t.Error(diff)
+	}
+	if project.settings["visibility"] != "private" || project.settings["default_branch"] != "main" {
+		t.Errorf("unexpected project settings %v", project.settings)
+	}
+	if len(project.mrs) != 1 || project.mrs[0]["source_branch"] != "feature" {
+		t.Errorf("unexpected merge requests %v", project.mrs)
+	}
+	if len(project.issues) != 1 || project.issues[0]["state"] != "closed" || !strings.HasPrefix(project.issues[0]["title"].(string), "Historical Bitbucket PR #1: ") {
+		t.Errorf("unexpected issues %v", project.issues)
+	}
+	if diff := deep.Equal(project.comments[mergeCommit], []string{"Bitbucket PR details: #2"}); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -14,5 +14,5 @@ require (
 	github.com/go-test/deep v1.1.1
 	github.com/google/go-querystring v1.1.0 // indirect
 	golang.org/x/net v0.39.0 // indirect
-	golang.org/x/oauth2 v0.29.0 // indirect
+	golang.org/x/oauth2 v0.29.0
 )
@@ -0,0 +1,59 @@
+package main
+
+// what a migration created on Github, so rollback can undo it.
+// It is written to STATE_DIR after every change so it survives a failed run
+type migrationJournal struct {
+	Owner string `json:"owner"`
+	Repo  string `json:"repo"`
+	// false when the repo already existed and was overwritten
+	RepoCreated  bool           `json:"repoCreated"`
+	PullRequests []int          `json:"pullRequests"`
+	Issues       []journalIssue `json:"issues"`
+	// ids of the commit comments linking merge commits to their issue
+	Comments []int64 `json:"comments"`
+
+	config settings
+}
+
+type journalIssue struct {
+	Number int    `json:"number"`
+	NodeID string `json:"nodeId"`
+}
+
+// the journal of the repo being migrated, nil when nothing is recorded
+var journal *migrationJournal
+
+// starts recording for repoName, continuing the journal of an earlier run.
+// The returned function stops recording
+func startJournal(repoName string, config settings) func() {
+	stop := func() { journal = nil }
+	if config.dryRun {
+		return stop
+	}
+	journal = &migrationJournal{
+		Owner:        config.ghOwner,
+		Repo:         repoName,
+		PullRequests: []int{},
+		Issues:       []journalIssue{},
+		Comments:     []int64{},
+	}
+	readState(config, repoName, "journal", journal)
+	journal.config = config
+	return stop
+}
+
+func readJournal(repoName string, config settings) *migrationJournal {
+	j := &migrationJournal{config: config}
+	if !readState(config, repoName, "journal", j) {
+		return nil
+	}
+	return j
+}
+
+func (j *migrationJournal) record(f func(j *migrationJournal)) {
+	if j == nil {
+		return
+	}
+	f(j)
+	writeState(j.config, j.Repo, "journal", j)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Github rejects pushes containing files over this size
+	// see https://docs.github.com/en/repositories/working-with-files/managing-large-files/about-large-files-on-github
+	githubMaxFileSize = 100 * 1024 * 1024
+	// Github warns about files over this size
+	githubWarnFileSize = 50 * 1024 * 1024
+	// how many commits to list for each large file
+	maxCommitsReported = 5
+)
+
+type largeBlob struct {
+	SHA     string
+	Size    int64
+	Path    string
+	Commits []string
+}
+
+// finds every blob in the history of any ref that is at least minSize bytes
+func findLargeBlobs(repoFolder string, minSize int64) ([]largeBlob, error) {
+	objects, err := runGit(repoFolder, "rev-list", "--objects", "--all")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err, objects)
+	}
+	cmd := exec.Command("git", "cat-file", "--batch-check=%(objectname) %(objecttype) %(objectsize) %(rest)")
+	cmd.Dir = repoFolder
+	cmd.Stdin = strings.NewReader(objects)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := []largeBlob{}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) != 4 || fields[1] != "blob" {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || size < minSize {
+			continue
+		}
+		commits, err := runGit(repoFolder, "log", "--all", "--format=%h", "-n", strconv.Itoa(maxCommitsReported), "--find-object="+fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", err, commits)
+		}
+		blobs = append(blobs, largeBlob{
+			SHA:     fields[0],
+			Size:    size,
+			Path:    fields[3],
+			Commits: strings.Fields(commits),
+		})
+	}
+	slices.SortFunc(blobs, func(a largeBlob, b largeBlob) int { return cmp.Compare(b.Size, a.Size) })
+	return blobs, nil
+}
+
+// checks the repo for files Github would reject and applies config.largeFileAction to them,
+// so the push doesn't fail halfway through
+func preflightLargeFiles(repoFolder string, config settings) {
+	slog.Info("Scanning history for large files")
+	blobs, err := findLargeBlobs(repoFolder, githubWarnFileSize)
+	if err != nil {
+		fatalf("Failed to scan repo for large files: %s", err)
+	}
+
+	tooLarge := []largeBlob{}
+	for _, blob := range blobs {
+		if blob.Size >= githubMaxFileSize {
+			tooLarge = append(tooLarge, blob)
+			slog.Error("File over Github's 100MB limit", "path", blob.Path, "size", blob.Size, "blob", blob.SHA, "commits", blob.Commits)
+		} else {
+			warn("File over 50MB", "path", blob.Path, "size", blob.Size, "blob", blob.SHA, "commits", blob.Commits)
+		}
+	}
+	if len(tooLarge) == 0 {
+		return
+	}
+
+	switch config.largeFileAction {
+	case "lfs":
+		if config.dryRun {
+			slog.Info("Mock converting files to LFS", "files", len(tooLarge))
+			return
+		}
+		convertToLfs(repoFolder, tooLarge)
+	case "strip":
+		if config.dryRun {
+			slog.Info("Mock stripping files from history", "files", len(tooLarge))
+			return
+		}
+		stripBlobs(repoFolder, tooLarge)
+	default:
+		fatalf("%d files are over Github's 100MB limit. Set LARGE_FILE_ACTION to lfs or strip to migrate this repo", len(tooLarge))
+	}
+}
+
+// rewrites history so every version of the large files is stored in LFS
+func convertToLfs(repoFolder string, blobs []largeBlob) {
+	paths := []string{}
+	for _, blob := range blobs {
+		if !slices.Contains(paths, blob.Path) {
+			paths = append(paths, blob.Path)
+		}
+	}
+	slog.Info("Converting files to LFS", "paths", paths)
+	_, err := runGitLogged(repoFolder, "lfs", "migrate", "import", "--everything", "--yes", "--include="+strings.Join(paths, ","))
+	if err != nil {
+		fatalf("Failed to convert large files to LFS, is git-lfs installed? err: %s", err)
+	}
+}
+
+// rewrites history without the blobs, using git fast-export and fast-import
+func stripBlobs(repoFolder string, blobs []largeBlob) {
+	strip := map[string]bool{}
+	for _, blob := range blobs {
+		slog.Info("Stripping file from history", "path", blob.Path, "blob", blob.SHA)
+		strip[blob.SHA] = true
+	}
+
+	export := exec.Command("git", "fast-export", "--all", "--no-data", "--signed-tags=strip", "--tag-of-filtered-object=rewrite", "--reencode=no")
+	export.Dir = repoFolder
+	stream, err := export.StdoutPipe()
+	if err != nil {
+		fatalf("Failed to run git fast-export: %s", err)
+	}
+	var importOutput bytes.Buffer
+	fastImport := exec.Command("git", "fast-import", "--force", "--quiet")
+	fastImport.Dir = repoFolder
+	fastImport.Stdout = &importOutput
+	fastImport.Stderr = &importOutput
+	importInput, err := fastImport.StdinPipe()
+	if err != nil {
+		fatalf("Failed to run git fast-import: %s", err)
+	}
+
+	if err = export.Start(); err != nil {
+		fatalf("Failed to run git fast-export: %s", err)
+	}
+	if err = fastImport.Start(); err != nil {
+		fatalf("Failed to run git fast-import: %s", err)
+	}
+	err = filterFastExport(stream, importInput, strip)
+	importInput.Close()
+	if err != nil {
+		fatalf("Failed to rewrite history: %s", err)
+	}
+	if err = export.Wait(); err != nil {
+		fatalf("git fast-export failed: %s", err)
+	}
+	if err = fastImport.Wait(); err != nil {
+		fatalf("git fast-import failed: %s\nOutput: %s", err, importOutput.String())
+	}
+	// the stripped blobs are now unreachable so they won't be pushed
+}
+
+// copies a fast-export stream made with --no-data, dropping file modifications that use a stripped blob
+func filterFastExport(input io.Reader, output io.Writer, strip map[string]bool) error {
+	reader := bufio.NewReader(input)
+	writer := bufio.NewWriter(output)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return writer.Flush()
+		} else if err != nil {
+			return err
+		}
+
+		if size, found := strings.CutPrefix(line, "data "); found {
+			// commit and tag messages are copied verbatim
+			n, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+			if err != nil {
+				return fmt.Errorf("bad data length %q", line)
+			}
+			writer.WriteString(line)
+			if _, err = io.CopyN(writer, reader, n); err != nil {
+				return err
+			}
+			continue
+		}
+		// M <mode> <sha> <path>
+		if fields := strings.SplitN(line, " ", 4); len(fields) == 4 && fields[0] == "M" && strip[fields[2]] {
+			continue
+		}
+		writer.WriteString(line)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStripBlobs(t *testing.T) {
+	work := t.TempDir()
+	git := func(dir string, args ...string) string {
+		args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+		output, err := runGit(dir, args...)
+		if err != nil {
+			t.Fatalf("git %v: %s", args, output)
+		}
+		return strings.TrimSpace(output)
+	}
+	git(work, "init", "-b", "main")
+	os.WriteFile(filepath.Join(work, "big.bin"), []byte("pretend this is huge"), 0o644)
+	os.WriteFile(filepath.Join(work, "small.txt"), []byte("small"), 0o644)
+	git(work, "add", ".")
+	git(work, "commit", "-m", "add files\n\ndata 5\nM 100644 not a command")
+	git(work, "tag", "-a", "v1", "-m", "release")
+	os.WriteFile(filepath.Join(work, "small.txt"), []byte("smaller"), 0o644)
+	git(work, "commit", "-am", "update small file")
+
+	mirror := filepath.Join(t.TempDir(), "mirror")
+	git("", "clone", "--mirror", work, mirror)
+	bigSHA := git(mirror, "rev-parse", "main:big.bin")
+
+	stripBlobs(mirror, []largeBlob{{SHA: bigSHA, Path: "big.bin"}})
+
+	files := git(mirror, "ls-tree", "-r", "--name-only", "v1")
+	if files != "small.txt" {
+		t.Errorf("expected only small.txt in v1, got %q", files)
+	}
+	if message := git(mirror, "log", "-1", "--format=%B", "v1^{commit}"); !strings.Contains(message, "M 100644 not a command") {
+		t.Errorf("commit message was not preserved: %q", message)
+	}
+	if count := git(mirror, "rev-list", "--count", "main"); count != "2" {
+		t.Errorf("expected 2 commits on main, got %s", count)
+	}
+	if objects := git(mirror, "rev-list", "--objects", "--all"); strings.Contains(objects, bigSHA) {
+		t.Error("stripped blob is still reachable")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LFS pointer files are small text files, anything bigger can be skipped
+const lfsPointerMaxSize = 1024
+
+// returns the oid and size of every LFS object referenced by a pointer file anywhere in the repo
+func findLfsObjects(repoFolder string) (map[string]int64, error) {
+	output, err := runGit(repoFolder, "cat-file", "--batch-all-objects", "--batch-check=%(objectname) %(objecttype) %(objectsize)")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err, output)
+	}
+	var candidates bytes.Buffer
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err == nil && size < lfsPointerMaxSize {
+			candidates.WriteString(fields[0] + "\n")
+		}
+	}
+
+	cmd := exec.Command("git", "cat-file", "--batch")
+	cmd.Dir = repoFolder
+	cmd.Stdin = &candidates
+	contents, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	objects := map[string]int64{}
+	reader := bufio.NewReader(bytes.NewReader(contents))
+	for {
+		// each object is printed as "<sha> <type> <size>\n<contents>\n"
+		header, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return objects, nil
+		} else if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected cat-file output %q", header)
+		}
+		size, _ := strconv.Atoi(fields[2])
+		blob := make([]byte, size+1)
+		_, err = io.ReadFull(reader, blob)
+		if err != nil {
+			return nil, err
+		}
+		if oid, objectSize, ok := parseLfsPointer(string(blob)); ok {
+			objects[oid] = objectSize
+		}
+	}
+}
+
+// see https://github.com/git-lfs/git-lfs/blob/main/docs/spec.md
+func parseLfsPointer(contents string) (oid string, size int64, ok bool) {
+	if !strings.HasPrefix(contents, "version https://git-lfs.github.com/spec/v1\n") {
+		return "", 0, false
+	}
+	for _, line := range strings.Split(contents, "\n") {
+		if value, found := strings.CutPrefix(line, "oid sha256:"); found {
+			oid = value
+		} else if value, found := strings.CutPrefix(line, "size "); found {
+			size, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return oid, size, oid != ""
+}
+
+func lfsTotalSize(objects map[string]int64) int64 {
+	var total int64
+	for _, size := range objects {
+		total += size
+	}
+	return total
+}
+
+// fetches every LFS object of the repo from bitbucket.
+// returns the objects that bitbucket did not have
+func fetchLfsObjects(repoFolder string, objects map[string]int64, env []string) []string {
+	slog.Info("Fetching LFS objects from bitbucket", "lfs_objects", len(objects), "lfs_bytes", lfsTotalSize(objects))
+	_, err := runGitLoggedEnv(repoFolder, env, "lfs", "fetch", "--all", "origin")
+	if err != nil {
+		fatalf("Failed to fetch LFS objects, is git-lfs installed? err: %s", err)
+	}
+
+	storage := lfsStorage(repoFolder)
+	missing := []string{}
+	for oid := range objects {
+		_, err := os.Stat(filepath.Join(storage, lfsObjectPath(oid)))
+		if err != nil {
+			missing = append(missing, oid)
+		}
+	}
+	return missing
+}
+
+// where git-lfs keeps the objects of the repo in repoFolder
+func lfsStorage(repoFolder string) string {
+	// work copies keep their objects with the mirror
+	if output, err := runGit(repoFolder, "config", "lfs.storage"); err == nil {
+		return strings.TrimSpace(output)
+	}
+	return filepath.Join(repoFolder, "lfs")
+}
+
+// the path of an object relative to the LFS storage
+func lfsObjectPath(oid string) string {
+	return filepath.Join("objects", oid[0:2], oid[2:4], oid)
+}
+
+// fetches the LFS objects referenced anywhere in the repo from bitbucket.
+// returns the objects that bitbucket did not have
+func fetchRepoLfsObjects(repoFolder string, config settings) []string {
+	if (!config.migrateLfs && config.largeFileAction != "lfs") || config.dryRun {
+		return nil
+	}
+	lfsObjects, err := findLfsObjects(repoFolder)
+	if err != nil {
+		fatalf("Failed to scan repo for LFS pointers: %s", err)
+	}
+	if len(lfsObjects) == 0 {
+		return nil
+	}
+	missing := fetchLfsObjects(repoFolder, lfsObjects, bitbucketGitEnv(config))
+	if len(missing) > 0 {
+		warn("LFS objects are missing on bitbucket and can't be migrated", "lfs_objects", missing)
+	}
+	return missing
+}
+
+func pushLfsObjects(repoFolder string, remote string, env []string) {
+	slog.Info("Pushing LFS objects")
+	_, err := runGitLoggedEnv(repoFolder, env, "lfs", "push", "--all", remote)
+	if err != nil {
+		fatalf("Failed to push LFS objects: %s", err)
+	}
+}
+
+type lfsBatchObject struct {
+	Oid     string         `json:"oid"`
+	Size    int64          `json:"size"`
+	Actions map[string]any `json:"actions,omitempty"`
+	Error   *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// asks the LFS server of the target for every object and returns the ones it can't serve
+// see https://github.com/git-lfs/git-lfs/blob/main/docs/api/batch.md
+func verifyLfsObjects(target migrationTarget, repoName string, objects map[string]int64) ([]string, error) {
+	const batchSize = 100
+	batchURL := strings.TrimSuffix(target.repoURL(repoName), "/") + "/info/lfs/objects/batch"
+	username, password := target.lfsCredentials()
+
+	all := []lfsBatchObject{}
+	for oid, size := range objects {
+		all = append(all, lfsBatchObject{Oid: oid, Size: size})
+	}
+
+	unresolved := []string{}
+	for start := 0; start < len(all); start += batchSize {
+		batch := all[start:min(start+batchSize, len(all))]
+		body, err := json.Marshal(map[string]any{
+			"operation": "download",
+			"transfers": []string{"basic"},
+			"objects":   batch,
+		})
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", batchURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/vnd.git-lfs+json")
+		req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+		req.SetBasicAuth(username, password)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Objects []lfsBatchObject `json:"objects"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("LFS batch request failed with status %s", resp.Status)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range result.Objects {
+			if object.Error != nil || object.Actions["download"] == nil {
+				unresolved = append(unresolved, object.Oid)
+			}
+		}
+	}
+	return unresolved, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestFindLfsObjects(t *testing.T) {
+	repo := t.TempDir()
+	if output, err := runGit(repo, "init", "--bare"); err != nil {
+		t.Fatal(output)
+	}
+	blobs := []string{
+		"version https://git-lfs.github.com/spec/v1\noid sha256:4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393\nsize 12345\n",
+		"not a pointer\n",
+	}
+	for _, blob := range blobs {
+		cmd := exec.Command("git", "hash-object", "-w", "--stdin")
+		cmd.Dir = repo
+		cmd.Stdin = strings.NewReader(blob)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatal(string(output))
+		}
+	}
+
+	result, err := findLfsObjects(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int64{"4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393": 12345}
+	if diff := deep.Equal(result, want); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// handler for console output, per repo log files are added on top of it
+var consoleHandler slog.Handler = slog.NewTextHandler(os.Stderr, nil)
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	return l, err
+}
+
+func newLogHandler(w io.Writer, format string, level slog.Level) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if strings.ToLower(format) == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+func setupLogging(config settings) {
+	level, err := parseLogLevel(config.logLevel)
+	if err != nil {
+		slog.Error("LOG_LEVEL must be one of debug, info, warn or error")
+		os.Exit(2)
+	}
+	consoleHandler = newLogHandler(os.Stdout, config.logFormat, level)
+	slog.SetDefault(slog.New(consoleHandler))
+}
+
+// logs everything about a repo, including full git output, to <logDir>/<repo>.log
+// until the returned function is called
+func startRepoLog(repoName string, config settings) (stop func()) {
+	if config.logDir == "" {
+		slog.SetDefault(slog.New(consoleHandler).With("repo", repoName))
+		return func() { slog.SetDefault(slog.New(consoleHandler)) }
+	}
+	err := os.MkdirAll(config.logDir, 0o755)
+	if err != nil {
+		fatalf("Failed to create log directory %s: %s", config.logDir, err)
+	}
+	logFile, err := os.OpenFile(filepath.Join(config.logDir, repoName+".log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		fatalf("Failed to create log file for %s: %s", repoName, err)
+	}
+	fileHandler := newLogHandler(logFile, config.logFormat, slog.LevelDebug)
+	slog.SetDefault(slog.New(fanoutHandler{consoleHandler, fileHandler}).With("repo", repoName))
+	return func() {
+		slog.SetDefault(slog.New(consoleHandler))
+		logFile.Close()
+	}
+}
+
+// adds a phase field to every log line until the returned function is called
+func startPhaseLog(phase string) (stop func()) {
+	previous := slog.Default()
+	slog.SetDefault(previous.With("phase", phase))
+	return func() { slog.SetDefault(previous) }
+}
+
+// sends every log record to all handlers
+type fanoutHandler []slog.Handler
+
+func (h fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h fanoutHandler) Handle(ctx context.Context, record slog.Record) error {
+	var errs []error
+	for _, handler := range h {
+		if handler.Enabled(ctx, record.Level) {
+			errs = append(errs, handler.Handle(ctx, record.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := fanoutHandler{}
+	for _, handler := range h {
+		handlers = append(handlers, handler.WithAttrs(attrs))
+	}
+	return handlers
+}
+
+func (h fanoutHandler) WithGroup(name string) slog.Handler {
+	handlers := fanoutHandler{}
+	for _, handler := range h {
+		handlers = append(handlers, handler.WithGroup(name))
+	}
+	return handlers
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStartRepoLog(t *testing.T) {
+	previous := consoleHandler
+	defer func() {
+		consoleHandler = previous
+		slog.SetDefault(slog.New(previous))
+	}()
+	var console bytes.Buffer
+	consoleHandler = newLogHandler(&console, "text", slog.LevelInfo)
+	config := settings{logDir: t.TempDir(), logFormat: "text"}
+
+	stopLog := startRepoLog("repo1", config)
+	stopPhase := startPhaseLog("push")
+	slog.Info("pushing")
+	runGitLogged("", "version")
+	stopPhase()
+	stopLog()
+	slog.Info("after the repo")
+
+	logFile, err := os.ReadFile(filepath.Join(config.logDir, "repo1.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(logFile)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines in the repo log, got %q", lines)
+	}
+	for _, want := range []string{
+		`level=INFO msg=pushing repo=repo1 phase=push`,
+		`level=DEBUG msg="git output" repo=repo1 phase=push command="git version" output="git version `,
+	} {
+		if !strings.Contains(string(logFile), want) {
+			t.Errorf("expected %q in the repo log, got %s", want, logFile)
+		}
+	}
+
+	// the console stays at its own level and only gets the repo attributes while the repo is logged
+	lines = strings.Split(strings.TrimSpace(console.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "msg=pushing repo=repo1 phase=push") || !strings.HasSuffix(lines[1], `msg="after the repo"`) {
+		t.Errorf("unexpected console output %q", lines)
+	}
+}
@@ -2,8 +2,9 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -11,6 +12,7 @@ import (
 	"github.com/google/go-github/v72/github"
 	"github.com/joho/godotenv"
 	"github.com/ktrysmt/go-bitbucket"
+	"golang.org/x/oauth2"
 )
 
 const (
@@ -20,14 +22,36 @@ const (
 
 type settings struct {
 	bbWorkspace         string
+	bbAuth              string
 	bbUsername          string
 	bbPassword          string
+	bbOAuthClientID     string
+	bbOAuthClientSecret string
+	bbOAuthTokenURL     string // a local server in tests
+	bbTokens            oauth2.TokenSource
+	bbURL               string // Bitbucket Data Center url, empty for Bitbucket Cloud
+	bbSSHURL            string // Bitbucket Data Center ssh url
 	revokeOldPerms      bool
+	bbFreeze            bool
+	bbMarkMoved         bool
+	bbMovedFile         bool
+	bbDisableIssuesWiki bool
 	cloneVia            string
 	ghOrg               string
 	ghUser              string
 	ghOwner             string
 	ghToken             string
+	ghAppID             int64
+	ghAppKeyFile        string
+	ghAppInstallationID int64
+	ghPushVia           string
+	ghSSHKey            string
+	ghIssueImport       bool
+	ghClosedPrsAsPrs    bool
+	target              string
+	glURL               string
+	glToken             string
+	glGroup             string
 	dryRun              bool
 	overwrite           bool
 	visibility          string
@@ -37,24 +61,64 @@ type settings struct {
 	migrateRepoSettings bool
 	migrateOpenPrs      bool
 	migrateClosedPrs    bool
+	migrateLfs          bool
+	largeFileAction     string
+	reportDir           string
+	stateDir            string
+	mirrorDir           string
+	minFreeSpaceMB      int64
+	exportFormat        string
+	logLevel            string
+	logFormat           string
+	logDir              string
+	bbGitURL            string // where https clones come from, a local path in tests
+	ghBaseURL           string // web and git host, a local path in tests
 }
 
 func main() {
+	// git runs btg to ask for credentials, see gitCredentialEnv
+	if os.Getenv(askpassEnv) != "" && len(os.Args) == 2 {
+		fmt.Println(askpass(os.Args[1]))
+		return
+	}
+
 	err := godotenv.Load(".env")
 	if err != nil {
-		log.Fatalf("Error loading .env file")
+		slog.Error("Error loading .env file")
+		os.Exit(2)
 	}
 
 	config := settings{
 		bbWorkspace:         os.Getenv("BITBUCKET_WORKSPACE"),
+		bbAuth:              strings.ToLower(getEnvOrDefault("BITBUCKET_AUTH", bitbucketAuthBasic)),
 		bbUsername:          os.Getenv("BITBUCKET_USER"),
 		bbPassword:          os.Getenv("BITBUCKET_TOKEN"),
+		bbOAuthClientID:     os.Getenv("BITBUCKET_OAUTH_CLIENT_ID"),
+		bbOAuthClientSecret: os.Getenv("BITBUCKET_OAUTH_CLIENT_SECRET"),
+		bbOAuthTokenURL:     bitbucketOAuthTokenURL,
+		bbURL:               strings.TrimSuffix(os.Getenv("BITBUCKET_URL"), "/"),
+		bbSSHURL:            strings.TrimSuffix(os.Getenv("BITBUCKET_SSH_URL"), "/"),
 		revokeOldPerms:      getEnvVarAsBool("BITBUCKET_REVOKEOLDPERMS"),
+		bbFreeze:            getEnvVarAsBoolOrDefault("BITBUCKET_FREEZE", false),
+		bbMarkMoved:         getEnvVarAsBoolOrDefault("BITBUCKET_MARK_MOVED", false),
+		bbMovedFile:         getEnvVarAsBoolOrDefault("BITBUCKET_MOVED_FILE", false),
+		bbDisableIssuesWiki: getEnvVarAsBoolOrDefault("BITBUCKET_DISABLE_ISSUES_WIKI", false),
 		cloneVia:            os.Getenv("CLONE_VIA"),
 		ghUser:              os.Getenv("GITHUB_USER"),
 		ghOrg:               os.Getenv("GITHUB_ORG"),
 		ghOwner:             "",
 		ghToken:             os.Getenv("GITHUB_TOKEN"),
+		ghAppID:             getEnvVarAsInt("GITHUB_APP_ID"),
+		ghAppKeyFile:        os.Getenv("GITHUB_APP_PRIVATE_KEY_FILE"),
+		ghAppInstallationID: getEnvVarAsInt("GITHUB_APP_INSTALLATION_ID"),
+		ghPushVia:           strings.ToLower(getEnvOrDefault("GITHUB_PUSH_VIA", "https")),
+		ghSSHKey:            os.Getenv("GITHUB_SSH_KEY"),
+		ghIssueImport:       getEnvVarAsBoolOrDefault("GITHUB_ISSUE_IMPORT", false),
+		ghClosedPrsAsPrs:    getEnvVarAsBoolOrDefault("GITHUB_CLOSED_PRS_AS_PRS", false),
+		target:              strings.ToLower(getEnvOrDefault("TARGET", "github")),
+		glURL:               strings.TrimSuffix(getEnvOrDefault("GITLAB_URL", defaultGitlabURL), "/"),
+		glToken:             os.Getenv("GITLAB_TOKEN"),
+		glGroup:             os.Getenv("GITLAB_GROUP"),
 		dryRun:              getEnvVarAsBool("GITHUB_DRYRUN"),
 		overwrite:           getEnvVarAsBool("GITHUB_OVERWRITE"),
 		visibility:          getEnvOrDefault("GITHUB_PRIVATE_VISIBILITY", "internal"),
@@ -64,31 +128,262 @@ func main() {
 		migrateRepoSettings: getEnvVarAsBool("MIGRATE_REPO_SETTINGS"),
 		migrateOpenPrs:      getEnvVarAsBool("MIGRATE_OPEN_PRS"),
 		migrateClosedPrs:    getEnvVarAsBool("MIGRATE_CLOSED_PRS"),
+		migrateLfs:          getEnvVarAsBoolOrDefault("MIGRATE_LFS", true),
+		largeFileAction:     getEnvOrDefault("LARGE_FILE_ACTION", "fail"),
+		reportDir:           getEnvOrDefault("REPORT_DIR", "reports"),
+		stateDir:            getEnvOrDefault("STATE_DIR", "state"),
+		mirrorDir:           getEnvOrDefault("MIRROR_DIR", "mirrors"),
+		minFreeSpaceMB:      getEnvVarAsIntOrDefault("MIN_FREE_SPACE_MB", 1024),
+		exportFormat:        strings.ToLower(getEnvOrDefault("EXPORT_FORMAT", "btg")),
+		logLevel:            getEnvOrDefault("LOG_LEVEL", "info"),
+		logFormat:           getEnvOrDefault("LOG_FORMAT", "text"),
+		logDir:              getEnvOrDefault("LOG_DIR", "logs"),
+		bbGitURL:            "https://bitbucket.org",
+		ghBaseURL:           strings.TrimSuffix(getEnvOrDefault("GITHUB_BASE_URL", defaultGithubURL), "/"),
 	}
 
-	if config.bbWorkspace == "" || config.bbUsername == "" || config.bbPassword == "" {
-		fmt.Println("BITBUCKET_WORKSPACE or BITBUCKET_USER or BITBUCKET_TOKEN not set in .env file or env vars")
+	setupLogging(config)
+
+	command := "migrate"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	// import never talks to bitbucket, it can run where bitbucket isn't reachable
+	if command != "import" {
+		checkBitbucketSettings(&config)
+	}
+
+	if config.bbURL != "" {
+		config.bbGitURL = config.bbURL + "/scm"
+		if strings.ToLower(config.cloneVia) == "ssh" && config.bbSSHURL == "" {
+			slog.Error("BITBUCKET_SSH_URL must be set to clone from Bitbucket Data Center via ssh")
+			os.Exit(2)
+		}
+	}
+
+	if !slices.Contains([]string{"fail", "lfs", "strip"}, config.largeFileAction) {
+		slog.Error("LARGE_FILE_ACTION must be one of fail, lfs or strip")
 		os.Exit(2)
 	}
 
-	if config.ghToken == "" {
-		fmt.Println("GITHUB_TOKEN not set in .env file or env vars")
+	if !slices.Contains([]string{"btg", "gei"}, config.exportFormat) {
+		slog.Error("EXPORT_FORMAT must be either btg or gei")
 		os.Exit(2)
 	}
 
-	if (config.ghUser == "" && config.ghOrg == "") || (config.ghUser != "" && config.ghOrg != "") {
-		fmt.Println("You must set either org or user but not both")
+	if !slices.Contains([]string{"private", "internal"}, config.visibility) {
+		slog.Error("GITHUB_PRIVATE_VISIBILITY must be either private or internal")
 		os.Exit(2)
 	}
 
-	config.ghOwner = strings.Join([]string{config.ghOrg, config.ghUser}, "")
+	if !slices.Contains([]string{"https", "ssh"}, config.ghPushVia) {
+		slog.Error("GITHUB_PUSH_VIA must be either https or ssh")
+		os.Exit(2)
+	}
 
-	repos := parseRepos(config.repoFile)
+	var target migrationTarget
+	var ghTarget *githubTarget
+	switch config.target {
+	case "github":
+		if (config.ghToken == "") == (config.ghAppID == 0) {
+			slog.Error("Set either GITHUB_TOKEN or GITHUB_APP_ID in .env file or env vars")
+			os.Exit(2)
+		}
+
+		if config.ghAppID != 0 && config.ghAppKeyFile == "" {
+			slog.Error("GITHUB_APP_PRIVATE_KEY_FILE must be set when using a Github App")
+			os.Exit(2)
+		}
+
+		if (config.ghUser == "" && config.ghOrg == "") || (config.ghUser != "" && config.ghOrg != "") {
+			slog.Error("You must set either org or user but not both")
+			os.Exit(2)
+		}
+
+		if config.visibility == "internal" && config.ghOrg == "" {
+			slog.Error("internal repos only exist in organizations, set GITHUB_PRIVATE_VISIBILITY=private when migrating to a user")
+			os.Exit(2)
+		}
 
-	bitbucketClient := bitbucket.NewBasicAuth(config.bbUsername, config.bbPassword)
-	githubClient := github.NewClient(nil).WithAuthToken(config.ghToken)
+		config.ghOwner = strings.Join([]string{config.ghOrg, config.ghUser}, "")
 
-	migrateRepos(githubClient, bitbucketClient, repos, config)
+		apiURL, err := githubAPIBaseURL(config)
+		if err != nil {
+			slog.Error("GITHUB_BASE_URL is not a valid url", "err", err)
+			os.Exit(2)
+		}
+		var tokens githubTokenSource = staticToken(config.ghToken)
+		if config.ghAppID != 0 {
+			app, err := newGithubAppAuth(config.ghAppID, config.ghAppKeyFile, config.ghAppInstallationID, apiURL)
+			if err != nil {
+				slog.Error("Failed to load Github App private key", "err", err)
+				os.Exit(2)
+			}
+			err = app.findInstallation(config.ghOwner, config.ghOrg != "")
+			if err != nil {
+				slog.Error(err.Error())
+				os.Exit(2)
+			}
+			tokens = app
+		}
+		githubAPIClient, err := newGithubAPIClient(config, tokens)
+		if err != nil {
+			slog.Error("Failed to create Github client", "err", err)
+			os.Exit(2)
+		}
+		ghTarget = &githubTarget{gh: newGithubClient(githubAPIClient), config: config, tokens: tokens}
+		target = ghTarget
+	case "gitlab":
+		if config.glToken == "" || config.glGroup == "" {
+			slog.Error("GITLAB_TOKEN or GITLAB_GROUP not set in .env file or env vars")
+			os.Exit(2)
+		}
+		// plans record the owner they were made for
+		config.ghOwner = config.glGroup
+		target = newGitlabTarget(newGitlabAPI(config.glURL, config.glToken), config)
+	default:
+		slog.Error("TARGET must be either github or gitlab")
+		os.Exit(2)
+	}
+
+	bitbucketClient := newSourceClient(config)
+
+	switch command {
+	case "migrate":
+		repos := parseRepos(config.repoFile)
+		report = newReport(config.reportDir)
+		migrateRepos(target, bitbucketClient, repos, config)
+	case "sync":
+		repos := parseRepos(config.repoFile)
+		report = newReport(config.reportDir)
+		syncRepos(target, bitbucketClient, repos, config)
+	case "export":
+		dir := "exports"
+		if len(os.Args) > 2 {
+			dir = os.Args[2]
+		}
+		if config.exportFormat == "gei" && ghTarget == nil {
+			slog.Error("EXPORT_FORMAT=gei only supports TARGET=github")
+			os.Exit(2)
+		}
+		repos := parseRepos(config.repoFile)
+		report = newReport(config.reportDir)
+		exportRepos(bitbucketClient, repos, dir, config)
+	case "import":
+		dir := "exports"
+		if len(os.Args) > 2 {
+			dir = os.Args[2]
+		}
+		repos := parseRepos(config.repoFile)
+		report = newReport(config.reportDir)
+		importRepos(target, repos, dir, config)
+	case "plan":
+		planFile := "plan.json"
+		if len(os.Args) > 2 {
+			planFile = os.Args[2]
+		}
+		repos := parseRepos(config.repoFile)
+		plan := newPlan(bitbucketClient, repos, config)
+		printPlan(plan)
+		writePlan(plan, planFile)
+	case "apply":
+		if len(os.Args) < 3 {
+			fmt.Println("usage: btg apply <plan file>")
+			os.Exit(2)
+		}
+		report = newReport(config.reportDir)
+		applyPlan(target, bitbucketClient, readPlan(os.Args[2]), config)
+	case "verify":
+		reportFile := ""
+		if len(os.Args) > 2 {
+			reportFile = os.Args[2]
+		}
+		if ghTarget == nil {
+			slog.Error("verify only supports TARGET=github")
+			os.Exit(2)
+		}
+		repos := parseRepos(config.repoFile)
+		if !verifyRepos(ghTarget, bitbucketClient, repos, config, reportFile) {
+			os.Exit(1)
+		}
+	case "unmark":
+		repos := os.Args[2:]
+		if len(repos) == 0 {
+			repos = parseRepos(config.repoFile)
+		}
+		for _, repo := range repos {
+			unmarkMoved(bitbucketClient, repo, config)
+		}
+	case "restore-permissions":
+		repos := os.Args[2:]
+		if len(repos) == 0 {
+			repos = parseRepos(config.repoFile)
+		}
+		for _, repo := range repos {
+			restorePermissions(bitbucketClient, repo, config)
+			unfreezeRepo(bitbucketClient, repo, config)
+		}
+	case "rollback":
+		mode := "delete"
+		if len(os.Args) > 3 {
+			mode = os.Args[3]
+		}
+		if len(os.Args) < 3 || !slices.Contains([]string{"delete", "archive", "keep"}, mode) {
+			fmt.Println("usage: btg rollback <repo> [delete | archive | keep]")
+			os.Exit(2)
+		}
+		if ghTarget == nil {
+			slog.Error("rollback only supports TARGET=github")
+			os.Exit(2)
+		}
+		failures := rollbackRepo(ghTarget, bitbucketClient, os.Args[2], mode, config)
+		if len(failures) > 0 {
+			fmt.Println("Could not undo:")
+			for _, failure := range failures {
+				fmt.Println("  " + failure)
+			}
+			os.Exit(1)
+		}
+		slog.Info("Rolled back", "repo", os.Args[2])
+	default:
+		fmt.Println("usage: btg [migrate | sync | export [dir] | import [dir] | plan [plan file] | apply <plan file> | verify [report file] | unmark [repo...] | restore-permissions [repo...] | rollback <repo> [delete | archive | keep]]")
+		os.Exit(2)
+	}
+}
+
+// exits when the bitbucket settings are incomplete
+func checkBitbucketSettings(config *settings) {
+	if config.bbWorkspace == "" {
+		slog.Error("BITBUCKET_WORKSPACE not set in .env file or env vars")
+		os.Exit(2)
+	}
+
+	switch config.bbAuth {
+	case bitbucketAuthBasic:
+		if config.bbUsername == "" || config.bbPassword == "" {
+			slog.Error("BITBUCKET_USER or BITBUCKET_TOKEN not set in .env file or env vars")
+			os.Exit(2)
+		}
+	case bitbucketAuthToken:
+		if config.bbPassword == "" {
+			slog.Error("BITBUCKET_TOKEN must be set to an access token when BITBUCKET_AUTH=token")
+			os.Exit(2)
+		}
+	case bitbucketAuthOAuth:
+		if config.bbOAuthClientID == "" || config.bbOAuthClientSecret == "" {
+			slog.Error("BITBUCKET_OAUTH_CLIENT_ID or BITBUCKET_OAUTH_CLIENT_SECRET not set in .env file or env vars")
+			os.Exit(2)
+		}
+		if config.bbURL != "" {
+			slog.Error("BITBUCKET_AUTH=oauth is only supported by Bitbucket Cloud")
+			os.Exit(2)
+		}
+		config.bbTokens = newBitbucketOAuth(*config)
+	default:
+		slog.Error("BITBUCKET_AUTH must be one of basic, token or oauth")
+		os.Exit(2)
+	}
 }
 
 // returns defaultVal if envVar is not present or empty
@@ -104,7 +399,36 @@ func getEnvOrDefault(envVar string, defaultVal string) string {
 func getEnvVarAsBool(envVar string) bool {
 	result, err := strconv.ParseBool(os.Getenv(envVar))
 	if err != nil {
-		fmt.Println("could not parse bool env var ", envVar)
+		slog.Error("could not parse bool env var", "env_var", envVar)
+		os.Exit(2)
+	}
+	return result
+}
+
+// returns defaultVal if envVar is not present or empty
+func getEnvVarAsBoolOrDefault(envVar string, defaultVal bool) bool {
+	if os.Getenv(envVar) == "" {
+		return defaultVal
+	}
+	return getEnvVarAsBool(envVar)
+}
+
+// returns defaultVal if envVar is not present or empty
+func getEnvVarAsIntOrDefault(envVar string, defaultVal int64) int64 {
+	if os.Getenv(envVar) == "" {
+		return defaultVal
+	}
+	return getEnvVarAsInt(envVar)
+}
+
+// returns 0 if envVar is not present or empty
+func getEnvVarAsInt(envVar string) int64 {
+	if os.Getenv(envVar) == "" {
+		return 0
+	}
+	result, err := strconv.ParseInt(os.Getenv(envVar), 10, 64)
+	if err != nil {
+		slog.Error("could not parse int env var", "env_var", envVar)
 		os.Exit(2)
 	}
 	return result
@@ -113,12 +437,12 @@ func getEnvVarAsBool(envVar string) bool {
 func parseRepos(repoFile string) []string {
 	var repos []string
 	if repoFile == "" {
-		fmt.Println("You must supply a list of names of repos to migrate in REPO_FILE")
+		slog.Error("You must supply a list of names of repos to migrate in REPO_FILE")
 		os.Exit(2)
 	}
 	data, err := os.ReadFile(strings.TrimSpace(repoFile))
 	if err != nil {
-		log.Fatalf("could not read file %s", repoFile)
+		fatalf("could not read file %s", repoFile)
 	}
 	repos = strings.Split(string(data), "\n")
 
@@ -146,62 +470,133 @@ func parseRepos(repoFile string) []string {
 	return cleaned_repos
 }
 
-func migrateRepos(gh *github.Client, bb *bitbucket.Client, repoList []string, config settings) {
+func migrateRepos(target migrationTarget, bb *bitbucketClient, repoList []string, config settings) {
 	if config.dryRun {
-		fmt.Println("Dry Run - not actually migrating anything")
+		slog.Info("Dry Run - not actually migrating anything")
 	}
 
 	for _, repo := range repoList {
-		migrateRepo(gh, bb, repo, config)
+		migrateRepo(target, bb, repo, config)
+	}
+}
+
+func migrateRepo(target migrationTarget, bb *bitbucketClient, repoName string, config settings) {
+	stopLog := startRepoLog(repoName, config)
+	defer stopLog()
+	report.startRepo(repoName)
+	stopJournal := startJournal(repoName, config)
+	defer stopJournal()
+
+	snapshot := snapshotRepo(bb, repoName, config)
+	defer os.RemoveAll(snapshot.folder)
+	migrateSnapshot(target, repoName, snapshot, config)
+
+	if config.bbMarkMoved {
+		report.phase("mark moved", func() {
+			markMoved(bb, repoName, strings.TrimSuffix(target.repoURL(repoName), ".git"), config)
+		})
 	}
+	report.finishRepo()
+	slog.Info("done migrating repo")
+
+	time.Sleep(GitHubRateLimitSleep)
+}
+
+// everything a migration needs from bitbucket, so export and import can run the two halves of it on different machines
+type repoSnapshot struct {
+	repo *bitbucket.Repository
+	// mirror clone of the repo with its LFS objects, empty when contents aren't migrated
+	folder string
+	prs    *PullRequests
+	// LFS objects that bitbucket didn't have
+	missingLfsObjects []string
 }
 
-func migrateRepo(gh *github.Client, bb *bitbucket.Client, repoName string, config settings) {
-	fmt.Println("Getting bitbucket settings for", repoName)
-	bbRepo := getRepo(bb, config.bbWorkspace, repoName)
+// the bitbucket half of a migration, callers remove the snapshot folder once they are done
+func snapshotRepo(bb *bitbucketClient, repoName string, config settings) repoSnapshot {
+	var snapshot repoSnapshot
+	slog.Info("Getting bitbucket settings")
+	report.phase("get bitbucket settings", func() {
+		snapshot.repo = getRepo(bb, config.bbWorkspace, repoName)
+	})
 
 	if config.revokeOldPerms {
-		fmt.Println("revoking old bitbucket permissions to prevent accidental writes")
-		updatePermissionsToReadOnly(bb, config.bbWorkspace, repoName, config.dryRun)
+		slog.Info("revoking old bitbucket permissions to prevent accidental writes")
+		report.phase("revoke permissions", func() {
+			updatePermissionsToReadOnly(bb, repoName, config)
+		})
 	} else {
-		fmt.Println("skipping revoking old bitbucket permissions")
+		slog.Info("skipping revoking old bitbucket permissions")
 	}
-
-	var repoFolder string
-	if config.migrateRepoContents {
-		repoFolder = cloneRepo(repoName, config)
+	if config.bbFreeze {
+		report.phase("freeze", func() {
+			freezeRepo(bb, repoName, config)
+		})
 	}
-	var prs *PullRequests
+
 	if config.migrateOpenPrs || config.migrateClosedPrs {
-		prs = getPrs(bb, config.bbWorkspace, repoName, bbRepo.Mainbranch.Name)
+		report.phase("get PRs", func() {
+			snapshot.prs = getPrs(bb, config.bbWorkspace, repoName, snapshot.repo.Mainbranch.Name)
+		})
 	}
-
-	fmt.Println("Migrating to Github")
-	ghRepo := createRepo(gh, bbRepo, config)
 	if config.migrateRepoContents {
-		pushRepoToGithub(repoFolder, repoName, config)
+		// the branches of open PRs from forks are fetched with the repo
+		var openPrs []plannedPullRequest
+		if config.migrateOpenPrs {
+			openPrs = renderOpenPrs(snapshot.prs, snapshot.repo.Mainbranch.Name)
+		}
+		report.phase("clone", func() {
+			snapshot.folder = cloneRepo(repoName, openPrs, config)
+			snapshot.missingLfsObjects = fetchRepoLfsObjects(snapshot.folder, config)
+		})
+	}
+	return snapshot
+}
+
+// the target half of a migration
+func migrateSnapshot(target migrationTarget, repoName string, snapshot repoSnapshot, config settings) {
+	slog.Info("Migrating to " + target.name())
+	var ghRepo *github.Repository
+	report.phase("create repo", func() {
+		ghRepo = target.createRepo(newGithubRepo(snapshot.repo, config))
+	})
+	report.update(func(repo *repoReport) {
+		repo.GithubURL = strings.TrimSuffix(target.repoURL(repoName), ".git")
+	})
+	if config.migrateRepoContents && snapshot.folder != "" {
+		report.phase("push", func() {
+			pushRepo(snapshot.folder, repoName, target, snapshot.missingLfsObjects, config)
+		})
 	} else {
-		fmt.Println("Skipping repo contents")
+		slog.Info("Skipping repo contents")
 	}
 	if config.migrateRepoSettings {
-		updateRepo(gh, config.ghOwner, ghRepo, config.dryRun)
-		updateRepoTopics(gh, config.ghOwner, ghRepo, config.dryRun)
-		updateCustomProperties(gh, config.ghOwner, ghRepo, config.dryRun, bbRepo.Project.Name)
+		report.phase("settings", func() {
+			target.updateSettings(ghRepo, newCustomProperties(snapshot.repo.Project.Name))
+		})
 	} else {
-		fmt.Println("Skipping repo settings")
+		slog.Info("Skipping repo settings")
 	}
-	if config.migrateOpenPrs {
-		migrateOpenPrs(gh, config.ghOwner, ghRepo, prs, config.dryRun)
+	var createdPrs map[int]int
+	if config.migrateOpenPrs && snapshot.prs != nil {
+		report.phase("open PRs", func() {
+			openPrs := renderOpenPrs(snapshot.prs, ghRepo.GetDefaultBranch())
+			if config.migrateRepoContents && snapshot.folder != "" {
+				pushPrHeads(snapshot.folder, repoName, target, openPrs, config)
+			}
+			createdPrs = target.createPullRequests(ghRepo, openPrs)
+		})
 	} else {
-		fmt.Println("Skipping open PR's")
+		slog.Info("Skipping open PR's")
 	}
-	if config.migrateClosedPrs {
-		createClosedPrs(gh, config.ghOwner, ghRepo, prs, config.dryRun)
+	var issues []plannedIssue
+	if config.migrateClosedPrs && snapshot.prs != nil {
+		report.phase("closed PRs", func() {
+			issues = renderClosedPrs(snapshot.prs)
+			target.createHistoricalRecords(ghRepo, issues)
+		})
 	} else {
-		fmt.Println("Skipping closed PR's")
+		slog.Info("Skipping closed PR's")
 	}
-	fmt.Println("done migrating repo")
-	fmt.Print("-----------------------\n\n")
-
-	time.Sleep(GitHubRateLimitSleep)
+	recordSync(repoName, targetRefs(target, repoName, config), createdPrs, nil, issues, config)
 }
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/google/go-github/v72/github"
+)
+
+// creates a repo on the fake bitbucket with a merged PR, an open PR and a tag.
+// returns the merge commit of the merged PR
+func seedBitbucketRepo(t *testing.T, bb *fakeBitbucket, workspace string, slug string) string {
+	bare := bb.addRepo(t, workspace, slug, "Platform Team", "main", true)
+	work := t.TempDir()
+	testGit(t, work, "init", "-b", "main")
+	os.WriteFile(filepath.Join(work, "readme.md"), []byte("hello"), 0o644)
+	testGit(t, work, "add", ".")
+	testGit(t, work, "commit", "-m", "initial commit")
+	testGit(t, work, "tag", "-a", "v1", "-m", "release")
+
+	testGit(t, work, "checkout", "-b", "done")
+	os.WriteFile(filepath.Join(work, "done.txt"), []byte("done"), 0o644)
+	testGit(t, work, "add", ".")
+	testGit(t, work, "commit", "-m", "finished work")
+	testGit(t, work, "checkout", "main")
+	testGit(t, work, "merge", "--no-ff", "-m", "Merged in done (pull request #1)", "done")
+	mergeCommit := testGit(t, work, "rev-parse", "HEAD")
+
+	testGit(t, work, "checkout", "-b", "feature")
+	os.WriteFile(filepath.Join(work, "feature.txt"), []byte("wip"), 0o644)
+	testGit(t, work, "add", ".")
+	testGit(t, work, "commit", "-m", "work in progress")
+
+	testGit(t, work, "push", bare, "--all")
+	testGit(t, work, "push", bare, "--tags")
+
+	bb.addPr(workspace, slug, 1, "MERGED", "Finish work", "done", mergeCommit)
+	bb.addPr(workspace, slug, 2, "OPEN", "Add feature", "feature", "")
+	bb.addUserPermission(workspace, slug, "account-1", "writer", "write")
+	bb.addUserPermission(workspace, slug, "account-2", "reader", "read")
+	bb.addGroupPermission(workspace, slug, "developers", "admin")
+	return mergeCommit
+}
+
+func TestMigrateRepo(t *testing.T) {
+	bb := newFakeBitbucket(t)
+	gh := newFakeGithub(t)
+	config := fakeSettings(t, bb, gh)
+	mergeCommit := seedBitbucketRepo(t, bb, config.bbWorkspace, "repo1")
+
+	migrateRepo(gh.target(config), bb.client(), "repo1", config)
+
+	for _, perm := range []struct{ kind, id, want string }{
+		{"user", "account-1", "read"},
+		{"user", "account-2", "read"},
+		{"group", "developers", "read"},
+	} {
+		if got := bb.permission(config.bbWorkspace, "repo1", perm.kind, perm.id); got != perm.want {
+			t.Errorf("%s %s has %s permission on bitbucket, expected %s", perm.kind, perm.id, got, perm.want)
+		}
+	}
+
+	repo := gh.repo("org", "repo1")
+	if repo == nil {
+		t.Fatal("repo was not created on github")
+	}
+	if diff := deep.Equal(repo.repo.GetVisibility(), "private"); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(repo.topics, []string{"migratedfrombitbucket", "platform-team"}); diff != nil {
+		t.Error(diff)
+	}
+	if len(repo.properties) != 2 || repo.properties[1].Value != "platform-team" {
+		t.Errorf("unexpected custom properties %v", repo.properties)
+	}
+
+	if len(repo.pulls) != 1 {
+		t.Fatalf("expected 1 PR, got %d", len(repo.pulls))
+	}
+	if pull := repo.pulls[0]; pull.GetHead().GetRef() != "feature" || !strings.HasPrefix(pull.GetTitle(), "Historical Bitbucket PR #2: ") {
+		t.Errorf("unexpected PR %s from %s", pull.GetTitle(), pull.GetHead().GetRef())
+	}
+	if len(repo.issues) != 1 {
+		t.Fatalf("expected 1 issue, got %d", len(repo.issues))
+	}
+	issue := repo.issues[0]
+	if issue.GetState() != "closed" || !strings.HasPrefix(issue.GetTitle(), "Historical Bitbucket PR #1: ") {
+		t.Errorf("unexpected %s issue %s", issue.GetState(), issue.GetTitle())
+	}
+	if diff := deep.Equal(repo.comments[mergeCommit], []string{"Bitbucket PR details: #2"}); diff != nil {
+		t.Error(diff)
+	}
+
+	// the fakes behave enough like the real thing for verify to pass
+	result := verifyRepo(gh.target(config), bb.client(), "repo1", config)
+	for _, check := range result.Checks {
+		if !check.Passed {
+			t.Errorf("verify check %s failed: %s", check.Name, check.Detail)
+		}
+	}
+
+	restorePermissions(bb.client(), "repo1", config)
+	for _, perm := range []struct{ kind, id, want string }{
+		{"user", "account-1", "write"},
+		{"user", "account-2", "read"},
+		{"group", "developers", "admin"},
+	} {
+		if got := bb.permission(config.bbWorkspace, "repo1", perm.kind, perm.id); got != perm.want {
+			t.Errorf("%s %s has %s permission on bitbucket after restoring, expected %s", perm.kind, perm.id, got, perm.want)
+		}
+	}
+}
+
+func TestMigrateRepoIssueImport(t *testing.T) {
+	issueImportPollInterval = 0
+	for _, tc := range []struct {
+		name          string
+		noIssueImport bool
+		wantCreatedAt time.Time
+	}{
+		{"import", false, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)},
+		{"fallback", true, time.Time{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bb := newFakeBitbucket(t)
+			gh := newFakeGithub(t)
+			gh.noIssueImport = tc.noIssueImport
+			config := fakeSettings(t, bb, gh)
+			config.ghIssueImport = true
+			mergeCommit := seedBitbucketRepo(t, bb, config.bbWorkspace, "repo1")
+
+			migrateRepo(gh.target(config), bb.client(), "repo1", config)
+
+			repo := gh.repo("org", "repo1")
+			if len(repo.issues) != 1 {
+				t.Fatalf("expected 1 issue, got %d", len(repo.issues))
+			}
+			issue := repo.issues[0]
+			if issue.GetState() != "closed" || !strings.HasPrefix(issue.GetTitle(), "Historical Bitbucket PR #1: ") {
+				t.Errorf("unexpected %s issue %s", issue.GetState(), issue.GetTitle())
+			}
+			if diff := deep.Equal(issue.GetCreatedAt().Time, tc.wantCreatedAt); diff != nil {
+				t.Error(diff)
+			}
+			if diff := deep.Equal(repo.comments[mergeCommit], []string{"Bitbucket PR details: #2"}); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestMigrateRepoClosedPrsAsPrs(t *testing.T) {
+	bb := newFakeBitbucket(t)
+	gh := newFakeGithub(t)
+	config := fakeSettings(t, bb, gh)
+	config.ghClosedPrsAsPrs = true
+	mergeCommit := seedBitbucketRepo(t, bb, config.bbWorkspace, "repo1")
+	bare := filepath.Join(bb.gitDir, config.bbWorkspace, "repo1.git")
+	source := testGit(t, bare, "rev-parse", "done")
+	// the first commit has no parent to open a PR against, so it is recorded as an issue
+	initialCommit := testGit(t, bare, "rev-list", "--max-parents=0", "main")
+	bb.addPr(config.bbWorkspace, "repo1", 3, "MERGED", "Start", "main", initialCommit)
+
+	migrateRepo(gh.target(config), bb.client(), "repo1", config)
+
+	repo := gh.repo("org", "repo1")
+	if len(repo.pulls) != 2 {
+		t.Fatalf("expected 2 PRs, got %d", len(repo.pulls))
+	}
+	pull := repo.pulls[1]
+	if pull.GetState() != "closed" || !strings.HasPrefix(pull.GetTitle(), "Historical Bitbucket PR #1: ") {
+		t.Errorf("unexpected %s PR %s", pull.GetState(), pull.GetTitle())
+	}
+	if diff := deep.Equal(pull.GetHead().GetSHA(), source); diff != nil {
+		t.Error(diff)
+	}
+	if len(pull.Labels) != 1 || pull.Labels[0].GetName() != "bitbucketPR" {
+		t.Errorf("unexpected labels %v", pull.Labels)
+	}
+	if !strings.HasPrefix(pull.GetBody(), "**Merged into main. ") {
+		t.Errorf("the branch the PR was merged into isn't in %q", pull.GetBody())
+	}
+	if diff := deep.Equal(repo.comments[mergeCommit], []string{"Bitbucket PR details: #2"}); diff != nil {
+		t.Error(diff)
+	}
+	if branches := testGit(t, gh.gitRepoDir(repo), "branch", "--list", "bitbucket-pr/*"); branches != "" {
+		t.Errorf("temporary branches weren't deleted: %s", branches)
+	}
+
+	if len(repo.issues) != 1 || !strings.HasPrefix(repo.issues[0].GetTitle(), "Historical Bitbucket PR #3: ") {
+		t.Fatalf("expected an issue for PR 3, got %v", repo.issues)
+	}
+	if diff := deep.Equal(repo.comments[initialCommit], []string{"Bitbucket PR details: #3"}); diff != nil {
+		t.Error(diff)
+	}
+
+	result := verifyRepo(gh.target(config), bb.client(), "repo1", config)
+	for _, check := range result.Checks {
+		if !check.Passed {
+			t.Errorf("verify check %s failed: %s", check.Name, check.Detail)
+		}
+	}
+}
+
+func TestCreateClosedPrCleansUp(t *testing.T) {
+	bb := newFakeBitbucket(t)
+	gh := newFakeGithub(t)
+	config := fakeSettings(t, bb, gh)
+	config.migrateClosedPrs = false
+	seedBitbucketRepo(t, bb, config.bbWorkspace, "repo1")
+	migrateRepo(gh.target(config), bb.client(), "repo1", config)
+	repo := gh.repo("org", "repo1")
+	ghBare := gh.gitRepoDir(repo)
+	source := testGit(t, filepath.Join(bb.gitDir, config.bbWorkspace, "repo1.git"), "rev-parse", "done")
+	planned := renderClosedPrs(getPrs(bb.client(), config.bbWorkspace, "repo1", "main"))[0]
+	stopJournal := startJournal("repo1", config)
+	defer stopJournal()
+
+	gh.failPullEdits = true
+	pr, err := createClosedPr(gh.client(), "org", "repo1", planned)
+	if err == nil || pr != nil {
+		t.Fatalf("expected closing the PR to fail, got %v, %v", pr, err)
+	}
+	// PR 1 is the open PR migrated before
+	if diff := deep.Equal(journal.PullRequests, []int{1, 2}); diff != nil {
+		t.Errorf("the PR isn't in the journal: %v", diff)
+	}
+	if branches := testGit(t, ghBare, "branch", "--list", "bitbucket-pr/*"); branches != "" {
+		t.Errorf("temporary branches weren't deleted: %s", branches)
+	}
+
+	// a branch left behind by a run that was killed
+	testGit(t, ghBare, "branch", "bitbucket-pr/1", "main")
+	gh.failPullEdits = false
+	pr, err = createClosedPr(gh.client(), "org", "repo1", planned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.GetNumber() != 3 || repo.pulls[2].GetState() != "closed" || repo.pulls[2].GetHead().GetSHA() != source {
+		t.Errorf("unexpected PR %+v", repo.pulls[2])
+	}
+	if branches := testGit(t, ghBare, "branch", "--list", "bitbucket-pr/*"); branches != "" {
+		t.Errorf("temporary branches weren't deleted: %s", branches)
+	}
+}
+
+func TestMigrateRepoRecoversPrHeads(t *testing.T) {
+	bb := newFakeBitbucket(t)
+	gh := newFakeGithub(t)
+	config := fakeSettings(t, bb, gh)
+	seedBitbucketRepo(t, bb, config.bbWorkspace, "repo1")
+	bare := filepath.Join(bb.gitDir, config.bbWorkspace, "repo1.git")
+	work := t.TempDir()
+	testGit(t, "", "clone", bare, work)
+
+	// the source branch of PR 3 was deleted after it was merged into another branch
+	testGit(t, work, "checkout", "-b", "gone", "origin/main")
+	os.WriteFile(filepath.Join(work, "gone.txt"), []byte("gone"), 0o644)
+	testGit(t, work, "add", ".")
+	testGit(t, work, "commit", "-m", "deleted work")
+	gone := testGit(t, work, "rev-parse", "HEAD")
+	testGit(t, work, "push", bare, "gone", "gone:keep")
+	bb.addPr(config.bbWorkspace, "repo1", 3, "OPEN", "Deleted branch", "gone", "")
+	testGit(t, bare, "branch", "-D", "gone")
+
+	// PR 4 is from a branch of a fork with the same name as a branch of the repo
+	fork := bb.addRepo(t, "other", "fork", "Platform Team", "main", true)
+	testGit(t, work, "checkout", "-b", "fork-work", "origin/main")
+	os.WriteFile(filepath.Join(work, "fork.txt"), []byte("fork"), 0o644)
+	testGit(t, work, "add", ".")
+	testGit(t, work, "commit", "-m", "fork work")
+	forked := testGit(t, work, "rev-parse", "HEAD")
+	testGit(t, work, "push", fork, "fork-work:feature")
+	bb.addForkPr(config.bbWorkspace, "repo1", 4, "From fork", "other", "fork", "feature")
+
+	migrateRepo(gh.target(config), bb.client(), "repo1", config)
+
+	repo := gh.repo("org", "repo1")
+	heads := map[string][2]string{}
+	for _, pull := range repo.pulls {
+		heads[strings.SplitN(pull.GetTitle(), ":", 2)[0]] = [2]string{pull.GetHead().GetRef(), pull.GetHead().GetSHA()}
+	}
+	featureSHA := testGit(t, bare, "rev-parse", "feature")
+	if diff := deep.Equal(heads, map[string][2]string{
+		"Historical Bitbucket PR #2": {"feature", featureSHA},
+		"Historical Bitbucket PR #3": {"bitbucket-pr/3", gone},
+		"Historical Bitbucket PR #4": {"bitbucket-pr/4", forked},
+	}); diff != nil {
+		t.Error(diff)
+	}
+	// the branch of the fork doesn't replace the repo's branch of the same name, and its commit is only on the PR's branch
+	if head := testGit(t, gh.gitRepoDir(repo), "rev-parse", "refs/heads/feature"); head != featureSHA {
+		t.Errorf("expected feature at %s, got %s", featureSHA, head)
+	}
+	for _, branch := range strings.Fields(testGit(t, gh.gitRepoDir(repo), "for-each-ref", "--contains", forked, "--format=%(refname)", "refs/heads/")) {
+		if !strings.HasPrefix(branch, "refs/heads/"+prBranchPrefix) {
+			t.Errorf("fork commit was pushed to %s", branch)
+		}
+	}
+}
+
+func TestMigrateRepoForkPrs(t *testing.T) {
+	bb := newFakeBitbucket(t)
+	gh := newFakeGithub(t)
+	config := fakeSettings(t, bb, gh)
+	config.revokeOldPerms = false
+	seedBitbucketRepo(t, bb, config.bbWorkspace, "repo1")
+	bare := filepath.Join(bb.gitDir, config.bbWorkspace, "repo1.git")
+
+	// the fork of PR 4 was migrated to a Github fork, the one of PR 5 wasn't
+	fork := bb.addRepo(t, "other", "fork", "Platform Team", "main", true)
+	testGit(t, bare, "push", fork, "main:feature")
+	fromFork := commitTo(t, fork, "feature", "fork.txt")
+	bb.addForkPr(config.bbWorkspace, "repo1", 4, "From fork", "other", "fork", "feature")
+	ghFork := gh.addFork(t, "org", "fork", "org/repo1")
+	testGit(t, fork, "push", ghFork, "feature")
+
+	fork2 := bb.addRepo(t, "other", "fork2", "Platform Team", "main", true)
+	testGit(t, bare, "push", fork2, "main:fix")
+	fromFork2 := commitTo(t, fork2, "fix", "fix.txt")
+	bb.addForkPr(config.bbWorkspace, "repo1", 5, "From other fork", "other", "fork2", "fix")
+
+	migrateRepo(gh.target(config), bb.client(), "repo1", config)
+
+	repo := gh.repo("org", "repo1")
+	pulls := map[string]*github.PullRequest{}
+	for _, pull := range repo.pulls {
+		pulls[strings.SplitN(pull.GetTitle(), ":", 2)[0]] = pull
+	}
+	if pull := pulls["Historical Bitbucket PR #4"]; pull.GetHead().GetRepo().GetName() != "fork" || pull.GetHead().GetRef() != "feature" || pull.GetHead().GetSHA() != fromFork {
+		t.Errorf("expected PR 4 from feature of the Github fork, got %+v", pull.GetHead())
+	}
+	pull := pulls["Historical Bitbucket PR #5"]
+	if pull.GetHead().GetRef() != "bitbucket-pr/5" || pull.GetHead().GetSHA() != fromFork2 {
+		t.Errorf("expected PR 5 from the imported branch, got %+v", pull.GetHead())
+	}
+	if !strings.Contains(pull.GetBody(), "from branch fix of the fork other/fork2") {
+		t.Errorf("fork isn't credited in %q", pull.GetBody())
+	}
+
+	// updates of fork branches are synced
+	updated := commitTo(t, fork2, "fix", "more.txt")
+	syncRepo(gh.target(config), bb.client(), "repo1", config)
+	if got := testGit(t, gh.gitRepoDir(repo), "rev-parse", "bitbucket-pr/5"); got != updated {
+		t.Errorf("expected bitbucket-pr/5 to be synced to %s, got %s", updated, got)
+	}
+}
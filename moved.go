@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+const movedFileName = "MOVED.md"
+
+// what marking a bitbucket repo as moved changed, so unmark can put it back
+type movedState struct {
+	MovedTo     string `json:"movedTo"`
+	Description string `json:"description"`
+	HasIssues   bool   `json:"hasIssues"`
+	HasWiki     bool   `json:"hasWiki"`
+	// branch MOVED.md was committed to, empty when it wasn't
+	MovedFileBranch string `json:"movedFileBranch"`
+}
+
+func movedDescription(movedTo string, description string) string {
+	if description == "" {
+		return "Moved to " + movedTo
+	}
+	return fmt.Sprintf("Moved to %s. %s", movedTo, description)
+}
+
+func movedFileContent(movedTo string) string {
+	return fmt.Sprintf("# This repository has moved\n\nIt now lives at %s, please clone it from there and make changes there.\n", movedTo)
+}
+
+// points people browsing the old repo at the new one
+func markMoved(bb *bitbucketClient, repoName string, movedTo string, config settings) {
+	if config.dryRun {
+		slog.Info("Mock marking bitbucket repo as moved", "url", movedTo)
+		return
+	}
+	slog.Info("Marking bitbucket repo as moved", "url", movedTo)
+	bbRepo := getRepo(bb, config.bbWorkspace, repoName)
+	state := movedState{
+		Description: bbRepo.Description,
+		HasIssues:   bbRepo.Has_issues,
+		HasWiki:     bbRepo.Has_wiki,
+	}
+	// marking a repo again keeps the settings from before it was first marked
+	readState(config, repoName, "moved", &state)
+	state.MovedTo = movedTo
+	// written before changing anything so a failure half way can still be undone
+	writeState(config, repoName, "moved", state)
+
+	repoSettings := bitbucketRepoSettings{Description: movedDescription(movedTo, state.Description)}
+	if config.bbDisableIssuesWiki {
+		disabled := false
+		repoSettings.HasIssues = &disabled
+		repoSettings.HasWiki = &disabled
+	}
+	err := bb.Settings.UpdateSettings(config.bbWorkspace, repoName, repoSettings)
+	if err != nil {
+		fatalf("Failed to update bitbucket repo settings: %s", err)
+	}
+
+	if config.bbMovedFile && state.MovedFileBranch == "" {
+		branch := bbRepo.Mainbranch.Name
+		slog.Info("Committing "+movedFileName, "branch", branch)
+		err = withoutFreeze(bb, repoName, config, func() error {
+			return bb.Settings.WriteFile(config.bbWorkspace, repoName, branch, movedFileName, []byte(movedFileContent(movedTo)), "Add "+movedFileName)
+		})
+		if err != nil {
+			fatalf("Failed to commit %s: %s", movedFileName, err)
+		}
+		state.MovedFileBranch = branch
+		writeState(config, repoName, "moved", state)
+	}
+}
+
+// undoes markMoved
+func unmarkMoved(bb *bitbucketClient, repoName string, config settings) {
+	var state movedState
+	if !readState(config, repoName, "moved", &state) {
+		slog.Info("Bitbucket repo isn't marked as moved", "repo", repoName)
+		return
+	}
+	if config.dryRun {
+		slog.Info("Mock unmarking bitbucket repo", "repo", repoName)
+		return
+	}
+	slog.Info("Unmarking bitbucket repo", "repo", repoName)
+	err := bb.Settings.UpdateSettings(config.bbWorkspace, repoName, bitbucketRepoSettings{
+		Description: state.Description,
+		HasIssues:   &state.HasIssues,
+		HasWiki:     &state.HasWiki,
+	})
+	if err != nil {
+		fatalf("Failed to restore bitbucket repo settings of %s: %s", repoName, err)
+	}
+	if state.MovedFileBranch != "" {
+		err = withoutFreeze(bb, repoName, config, func() error {
+			return bb.Settings.DeleteFile(config.bbWorkspace, repoName, state.MovedFileBranch, movedFileName, "Remove "+movedFileName)
+		})
+		if err != nil {
+			warn("Failed to remove "+movedFileName+", remove it by hand", "repo", repoName, "branch", state.MovedFileBranch, "err", err)
+		}
+	}
+	removeState(config, repoName, "moved")
+}
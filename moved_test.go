@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMarkMoved(t *testing.T) {
+	bb := newFakeBitbucket(t)
+	gh := newFakeGithub(t)
+	bb.addRepo(t, "workspace", "repo", "project", "main", true)
+	bb.repos["workspace/repo"]["has_issues"] = true
+	config := fakeSettings(t, bb, gh)
+	config.bbMovedFile = true
+	config.bbDisableIssuesWiki = true
+	client := bb.client()
+
+	// btg lifts its own freeze to commit MOVED.md
+	freezeRepo(client, "repo", config)
+	markMoved(client, "repo", "https://github.com/org/repo", config)
+	// marking again must not lose the original description
+	markMoved(client, "repo", "https://github.com/org/repo", config)
+
+	repo := bb.repos["workspace/repo"]
+	if repo["description"] != "Moved to https://github.com/org/repo. the repo repo" {
+		t.Errorf("unexpected description %q", repo["description"])
+	}
+	if repo["has_issues"] != false || repo["has_wiki"] != false {
+		t.Errorf("expected issues and wiki to be disabled, got %v and %v", repo["has_issues"], repo["has_wiki"])
+	}
+	if !strings.Contains(bb.files["workspace/repo"][movedFileName], "https://github.com/org/repo") {
+		t.Errorf("expected %s to point at the new repo, got %q", movedFileName, bb.files["workspace/repo"][movedFileName])
+	}
+
+	if len(bb.restrictions["workspace/repo"]) != 2 {
+		t.Errorf("expected the repo to be frozen again, got restrictions %v", bb.restrictions["workspace/repo"])
+	}
+
+	unmarkMoved(client, "repo", config)
+	unfreezeRepo(client, "repo", config)
+
+	if repo["description"] != "the repo repo" || repo["has_issues"] != true || repo["has_wiki"] != false {
+		t.Errorf("expected the repo settings to be restored, got %q, %v, %v", repo["description"], repo["has_issues"], repo["has_wiki"])
+	}
+	if _, ok := bb.files["workspace/repo"][movedFileName]; ok {
+		t.Errorf("expected %s to be removed", movedFileName)
+	}
+	if readState(config, "repo", "moved", &movedState{}) || readState(config, "repo", "freeze", &freezeState{}) {
+		t.Error("expected the moved and freeze state to be removed")
+	}
+	if len(bb.restrictions["workspace/repo"]) != 0 {
+		t.Errorf("expected the repo to be unfrozen, got restrictions %v", bb.restrictions["workspace/repo"])
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v72/github"
+	"github.com/ktrysmt/go-bitbucket"
+)
+
+// everything a migration will do, computed up front so it can be reviewed and applied later
+type migrationPlan struct {
+	CreatedAt          time.Time  `json:"createdAt"`
+	BitbucketWorkspace string     `json:"bitbucketWorkspace"`
+	GithubOwner        string     `json:"githubOwner"`
+	Repos              []repoPlan `json:"repos"`
+}
+
+type repoPlan struct {
+	Name string `json:"name"`
+	// state of the bitbucket repo when the plan was made.
+	// apply refuses to run if this has changed
+	Bitbucket bitbucketState `json:"bitbucket"`
+
+	Permissions      []permissionChange            `json:"permissions"`
+	Freeze           bool                          `json:"freeze"`
+	GithubRepo       *github.Repository            `json:"githubRepo"`
+	PushContents     bool                          `json:"pushContents"`
+	RunProgram       string                        `json:"runProgram"`
+	Refs             []plannedRef                  `json:"refs"`
+	LfsObjects       int                           `json:"lfsObjects"`
+	LfsBytes         int64                         `json:"lfsBytes"`
+	UpdateSettings   bool                          `json:"updateSettings"`
+	CustomProperties []*github.CustomPropertyValue `json:"customProperties"`
+	PullRequests     []plannedPullRequest          `json:"pullRequests"`
+	Issues           []plannedIssue                `json:"issues"`
+	MarkMoved        bool                          `json:"markMoved"`
+}
+
+type plannedRef struct {
+	Name string `json:"name"`
+	SHA  string `json:"sha"`
+	// size of all objects reachable from the ref
+	SizeBytes int64 `json:"sizeBytes"`
+}
+
+// the parts of a bitbucket repo that a plan is computed from
+type bitbucketState struct {
+	Description  string             `json:"description"`
+	IsPrivate    bool               `json:"isPrivate"`
+	MainBranch   string             `json:"mainBranch"`
+	Language     string             `json:"language"`
+	ProjectName  string             `json:"projectName"`
+	Refs         map[string]string  `json:"refs"`
+	PullRequests []pullRequestState `json:"pullRequests"`
+	// permission of each user or group, keyed by kind:id
+	Permissions map[string]string `json:"permissions"`
+}
+
+type pullRequestState struct {
+	ID        int       `json:"id"`
+	State     string    `json:"state"`
+	UpdatedOn time.Time `json:"updatedOn"`
+}
+
+func getBitbucketState(bb *bitbucketClient, bbRepo *bitbucket.Repository, prs *PullRequests, config settings) bitbucketState {
+	refs, err := listRemoteRefs(bitbucketCloneURL(bbRepo.Slug, config), bitbucketGitEnv(config))
+	if err != nil {
+		fatalf("Failed to list refs of %s: %s", bbRepo.Slug, err)
+	}
+	state := bitbucketState{
+		Description:  bbRepo.Description,
+		IsPrivate:    bbRepo.Is_private,
+		MainBranch:   bbRepo.Mainbranch.Name,
+		Language:     bbRepo.Language,
+		ProjectName:  bbRepo.Project.Name,
+		Refs:         refs,
+		PullRequests: []pullRequestState{},
+		Permissions:  map[string]string{},
+	}
+	for _, pr := range prs.Values {
+		state.PullRequests = append(state.PullRequests, pullRequestState{ID: pr.ID, State: pr.State, UpdatedOn: pr.UpdatedOn})
+	}
+	for _, perm := range getPermissions(bb, config.bbWorkspace, bbRepo.Slug) {
+		state.Permissions[perm.Kind+":"+perm.ID] = perm.From
+	}
+	return state
+}
+
+// describes every difference between the planned and current bitbucket state
+func (planned bitbucketState) diff(current bitbucketState) []string {
+	diffs := []string{}
+	compare := func(field string, old any, new any) {
+		if old != new {
+			diffs = append(diffs, fmt.Sprintf("%s changed from %v to %v", field, old, new))
+		}
+	}
+	compare("description", planned.Description, current.Description)
+	compare("private", planned.IsPrivate, current.IsPrivate)
+	compare("main branch", planned.MainBranch, current.MainBranch)
+	compare("language", planned.Language, current.Language)
+	compare("project", planned.ProjectName, current.ProjectName)
+	compareMaps := func(kind string, old map[string]string, new map[string]string) {
+		for _, key := range slices.Sorted(maps.Keys(old)) {
+			oldVal := old[key]
+			newVal, ok := new[key]
+			if !ok {
+				diffs = append(diffs, fmt.Sprintf("%s %s was removed", kind, key))
+			} else if newVal != oldVal {
+				diffs = append(diffs, fmt.Sprintf("%s %s changed from %s to %s", kind, key, oldVal, newVal))
+			}
+		}
+		for _, key := range slices.Sorted(maps.Keys(new)) {
+			if _, ok := old[key]; !ok {
+				diffs = append(diffs, fmt.Sprintf("%s %s was added", kind, key))
+			}
+		}
+	}
+	compareMaps("ref", planned.Refs, current.Refs)
+	compareMaps("permission", planned.Permissions, current.Permissions)
+	if !slices.EqualFunc(planned.PullRequests, current.PullRequests, func(a pullRequestState, b pullRequestState) bool {
+		return a.ID == b.ID && a.State == b.State && a.UpdatedOn.Equal(b.UpdatedOn)
+	}) {
+		diffs = append(diffs, "pull requests have been opened, updated or merged")
+	}
+	return diffs
+}
+
+func newPlan(bb *bitbucketClient, repoList []string, config settings) *migrationPlan {
+	plan := &migrationPlan{
+		CreatedAt:          time.Now(),
+		BitbucketWorkspace: config.bbWorkspace,
+		GithubOwner:        config.ghOwner,
+		Repos:              []repoPlan{},
+	}
+	for _, repo := range repoList {
+		plan.Repos = append(plan.Repos, planRepo(bb, repo, config))
+	}
+	return plan
+}
+
+func planRepo(bb *bitbucketClient, repoName string, config settings) repoPlan {
+	slog.Info("Planning migration", "repo", repoName)
+	bbRepo := getRepo(bb, config.bbWorkspace, repoName)
+	prs := getPrs(bb, config.bbWorkspace, repoName, bbRepo.Mainbranch.Name)
+
+	p := repoPlan{
+		Name:             repoName,
+		Bitbucket:        getBitbucketState(bb, bbRepo, prs, config),
+		Permissions:      []permissionChange{},
+		Freeze:           config.bbFreeze,
+		GithubRepo:       newGithubRepo(bbRepo, config),
+		PushContents:     config.migrateRepoContents,
+		RunProgram:       config.runProgram,
+		Refs:             []plannedRef{},
+		UpdateSettings:   config.migrateRepoSettings,
+		CustomProperties: newCustomProperties(bbRepo.Project.Name),
+		PullRequests:     []plannedPullRequest{},
+		Issues:           []plannedIssue{},
+		MarkMoved:        config.bbMarkMoved,
+	}
+	if config.revokeOldPerms {
+		p.Permissions = getReadOnlyPermissionChanges(bb, config.bbWorkspace, repoName)
+	}
+	if config.migrateRepoContents {
+		repoFolder := cloneRepo(repoName, nil, config)
+		defer os.RemoveAll(repoFolder)
+		refs, err := listLocalRefs(repoFolder)
+		if err != nil {
+			fatalf("Failed to list refs of %s: %s", repoName, err)
+		}
+		for ref, sha := range refs {
+			size, err := refDiskUsage(repoFolder, ref)
+			if err != nil {
+				fatalf("Failed to get size of %s: %s", ref, err)
+			}
+			p.Refs = append(p.Refs, plannedRef{Name: ref, SHA: sha, SizeBytes: size})
+		}
+		slices.SortFunc(p.Refs, func(a plannedRef, b plannedRef) int {
+			return cmp.Compare(a.Name, b.Name)
+		})
+		if config.migrateLfs {
+			lfsObjects, err := findLfsObjects(repoFolder)
+			if err != nil {
+				fatalf("Failed to scan %s for LFS pointers: %s", repoName, err)
+			}
+			p.LfsObjects = len(lfsObjects)
+			p.LfsBytes = lfsTotalSize(lfsObjects)
+		}
+	}
+	if config.migrateOpenPrs {
+		p.PullRequests = renderOpenPrs(prs, bbRepo.Mainbranch.Name)
+	}
+	if config.migrateClosedPrs {
+		p.Issues = renderClosedPrs(prs)
+	}
+	return p
+}
+
+func printPlan(plan *migrationPlan) {
+	for _, p := range plan.Repos {
+		fmt.Printf("Repo %s -> %s/%s (%s)\n", p.Name, plan.GithubOwner, *p.GithubRepo.Name, *p.GithubRepo.Visibility)
+		for _, perm := range p.Permissions {
+			fmt.Printf("  bitbucket %s %s permission: %s -> %s\n", perm.Kind, perm.Name, perm.From, perm.To)
+		}
+		if p.Freeze {
+			fmt.Printf("  freeze bitbucket repo, nobody can push to any branch\n")
+		}
+		if p.PushContents {
+			var largest int64
+			for _, ref := range p.Refs {
+				largest = max(largest, ref.SizeBytes)
+			}
+			fmt.Printf("  push %d refs (largest ref is %d bytes)\n", len(p.Refs), largest)
+			if p.LfsObjects > 0 {
+				fmt.Printf("  push %d LFS objects (%d bytes)\n", p.LfsObjects, p.LfsBytes)
+			}
+		}
+		if p.UpdateSettings {
+			fmt.Printf("  set default branch %s, topics %v\n", *p.GithubRepo.DefaultBranch, p.GithubRepo.Topics)
+			for _, prop := range p.CustomProperties {
+				fmt.Printf("  set custom property %s=%v\n", prop.PropertyName, prop.Value)
+			}
+		}
+		for _, pr := range p.PullRequests {
+			fmt.Printf("  create PR %q from %s\n", pr.Title, pr.Head)
+		}
+		for _, issue := range p.Issues {
+			fmt.Printf("  create closed issue %q\n", issue.Title)
+		}
+		if p.MarkMoved {
+			fmt.Printf("  mark bitbucket repo as moved\n")
+		}
+	}
+}
+
+func writePlan(plan *migrationPlan, planFile string) {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		fatalf("Failed to encode plan: %s", err)
+	}
+	err = os.WriteFile(planFile, data, 0o644)
+	if err != nil {
+		fatalf("Failed to write plan to %s: %s", planFile, err)
+	}
+	slog.Info("Plan written", "file", planFile)
+}
+
+func readPlan(planFile string) *migrationPlan {
+	data, err := os.ReadFile(planFile)
+	if err != nil {
+		fatalf("could not read plan %s", planFile)
+	}
+	plan := &migrationPlan{}
+	err = json.Unmarshal(data, plan)
+	if err != nil {
+		fatalf("could not parse plan %s: %s", planFile, err)
+	}
+	return plan
+}
+
+func applyPlan(target migrationTarget, bb *bitbucketClient, plan *migrationPlan, config settings) {
+	if plan.BitbucketWorkspace != config.bbWorkspace || plan.GithubOwner != config.ghOwner {
+		fatalf("Plan was made for %s -> %s but config is %s -> %s",
+			plan.BitbucketWorkspace, plan.GithubOwner, config.bbWorkspace, config.ghOwner)
+	}
+	if config.dryRun {
+		slog.Info("Dry Run - not actually migrating anything")
+	}
+	for _, p := range plan.Repos {
+		applyRepoPlan(target, bb, p, config)
+	}
+}
+
+// refuses to continue if the bitbucket repo has changed since the plan was made
+func checkDrift(bb *bitbucketClient, p repoPlan, config settings) {
+	bbRepo := getRepo(bb, config.bbWorkspace, p.Name)
+	prs := getPrs(bb, config.bbWorkspace, p.Name, bbRepo.Mainbranch.Name)
+	current := getBitbucketState(bb, bbRepo, prs, config)
+	if diffs := p.Bitbucket.diff(current); len(diffs) > 0 {
+		for _, diff := range diffs {
+			slog.Error("Bitbucket repo changed", "change", diff)
+		}
+		fatalf("Bitbucket repo %s has changed since the plan was made, make a new plan", p.Name)
+	}
+}
+
+func applyRepoPlan(target migrationTarget, bb *bitbucketClient, p repoPlan, config settings) {
+	report.startRepo(p.Name)
+	stopJournal := startJournal(p.Name, config)
+	defer stopJournal()
+	stopLog := startRepoLog(p.Name, config)
+	defer stopLog()
+	slog.Info("Applying plan")
+	report.phase("check drift", func() {
+		checkDrift(bb, p, config)
+	})
+
+	report.phase("revoke permissions", func() {
+		if len(p.Permissions) > 0 {
+			snapshotPermissions(bb, p.Name, config)
+		}
+		setPermissions(bb, config.bbWorkspace, p.Name, p.Permissions, config.dryRun)
+	})
+	if p.Freeze {
+		report.phase("freeze", func() {
+			freezeRepo(bb, p.Name, config)
+		})
+	}
+
+	var repoFolder string
+	var missingLfsObjects []string
+	if p.PushContents {
+		report.phase("clone", func() {
+			repoFolder = cloneRepo(p.Name, p.PullRequests, config)
+			missingLfsObjects = fetchRepoLfsObjects(repoFolder, config)
+		})
+		defer os.RemoveAll(repoFolder)
+		// refs may have been pushed between the drift check and revoking permissions
+		refs, err := listLocalRefs(repoFolder)
+		if err != nil {
+			fatalf("Failed to list refs of %s: %s", p.Name, err)
+		}
+		// the branches of forks aren't in the plan
+		maps.DeleteFunc(refs, func(ref string, _ string) bool { return strings.HasPrefix(ref, "refs/heads/"+prBranchPrefix) })
+		changed := len(refs) != len(p.Refs)
+		for _, ref := range p.Refs {
+			changed = changed || refs[ref.Name] != ref.SHA
+		}
+		if changed {
+			fatalf("Refs of %s changed while applying the plan, make a new plan", p.Name)
+		}
+	}
+
+	slog.Info("Migrating to " + target.name())
+	var ghRepo *github.Repository
+	report.phase("create repo", func() {
+		ghRepo = target.createRepo(p.GithubRepo)
+	})
+	report.update(func(repo *repoReport) {
+		repo.GithubURL = strings.TrimSuffix(target.repoURL(p.Name), ".git")
+	})
+	if p.PushContents {
+		pushConfig := config
+		pushConfig.runProgram = p.RunProgram
+		report.phase("push", func() {
+			pushRepo(repoFolder, p.Name, target, missingLfsObjects, pushConfig)
+		})
+	}
+	if p.UpdateSettings {
+		report.phase("settings", func() {
+			target.updateSettings(ghRepo, p.CustomProperties)
+		})
+	}
+	var createdPrs map[int]int
+	report.phase("open PRs", func() {
+		if p.PushContents {
+			pushPrHeads(repoFolder, p.Name, target, p.PullRequests, config)
+		}
+		createdPrs = target.createPullRequests(ghRepo, p.PullRequests)
+	})
+	report.phase("closed PRs", func() {
+		target.createHistoricalRecords(ghRepo, p.Issues)
+	})
+	if p.MarkMoved {
+		report.phase("mark moved", func() {
+			markMoved(bb, p.Name, strings.TrimSuffix(target.repoURL(p.Name), ".git"), config)
+		})
+	}
+	recordSync(p.Name, targetRefs(target, p.Name, config), createdPrs, nil, p.Issues, config)
+	report.finishRepo()
+	slog.Info("Done applying plan")
+
+	time.Sleep(GitHubRateLimitSleep)
+}
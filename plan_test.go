@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestBitbucketStateDiff(t *testing.T) {
+	created := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	planned := bitbucketState{
+		MainBranch:   "main",
+		Refs:         map[string]string{"refs/heads/main": "aaa", "refs/tags/v1": "bbb"},
+		PullRequests: []pullRequestState{{ID: 1, State: "OPEN", UpdatedOn: created}},
+		Permissions:  map[string]string{"user:1": "write"},
+	}
+
+	current := planned
+	current.PullRequests = []pullRequestState{{ID: 1, State: "OPEN", UpdatedOn: created.In(time.FixedZone("", 0))}}
+	if diff := planned.diff(current); len(diff) != 0 {
+		t.Errorf("expected no drift, got %v", diff)
+	}
+
+	current.MainBranch = "master"
+	current.Refs = map[string]string{"refs/heads/main": "ccc", "refs/heads/new": "ddd"}
+	want := []string{
+		"main branch changed from main to master",
+		"ref refs/heads/main changed from aaa to ccc",
+		"ref refs/tags/v1 was removed",
+		"ref refs/heads/new was added",
+	}
+	if diff := deep.Equal(planned.diff(current), want); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// btg's own branches on the target, for PR heads that have no branch of their own there
+const prBranchPrefix = "bitbucket-pr/"
+
+func prBranch(bitbucketID int) string {
+	return fmt.Sprintf("%s%d", prBranchPrefix, bitbucketID)
+}
+
+// the full name of the repo a PR side is in, "" when bitbucket didn't return one
+func prRepoFullName(side map[string]any) string {
+	repo, _ := side["repository"].(map[string]any)
+	name, _ := repo["full_name"].(string)
+	return name
+}
+
+// reports whether a PR is from another repo than the one it is merged into
+func isForkPr(pr PullRequest) bool {
+	source, destination := prRepoFullName(pr.Source), prRepoFullName(pr.Destination)
+	return source != "" && destination != "" && !strings.EqualFold(source, destination)
+}
+
+// fetches the source branches of prs from forks into bitbucket-pr/<id> branches of the mirror,
+// so they are migrated with the repo as the heads of the PRs
+func fetchForkBranches(mirror string, prs []plannedPullRequest, config settings) {
+	for _, pr := range prs {
+		if !pr.Fork {
+			continue
+		}
+		workspace, slug, _ := strings.Cut(pr.SourceRepo, "/")
+		forkConfig := config
+		forkConfig.bbWorkspace = workspace
+		slog.Info("Fetching PR from fork", "pr", pr.BitbucketID, "fork", pr.SourceRepo, "branch", pr.SourceBranch)
+		refspec := fmt.Sprintf("+refs/heads/%s:refs/heads/%s", pr.SourceBranch, prBranch(pr.BitbucketID))
+		output, err := runGitLoggedEnv(mirror, bitbucketGitEnv(config), "fetch", "--no-tags", bitbucketCloneURL(slug, forkConfig), refspec)
+		if err != nil {
+			warn("Failed to fetch PR from its fork", "pr", pr.BitbucketID, "fork", pr.SourceRepo, "err", err, "output", output)
+		}
+	}
+}
+
+// pushes the source commits of open PRs whose head branch isn't in the repo to bitbucket-pr/<id> branches
+// on the target and points the PRs at them. That is PRs whose source branch was deleted, and PRs from forks
+// whose branch couldn't be fetched. PRs whose commit can't be found are left as they are
+func pushPrHeads(repoFolder string, repoName string, target migrationTarget, prs []plannedPullRequest, config settings) {
+	refspecs := []string{}
+	for i := range prs {
+		pr := &prs[i]
+		_, err := runGit(repoFolder, "rev-parse", "--verify", "--quiet", "refs/heads/"+pr.Head)
+		if err == nil {
+			continue
+		}
+		commit := ""
+		if pr.SourceCommit != "" {
+			output, err := runGit(repoFolder, "rev-parse", "--verify", "--quiet", pr.SourceCommit+"^{commit}")
+			if err == nil {
+				commit = strings.TrimSpace(output)
+			}
+		}
+		if commit == "" {
+			warn("Can't find the source commit of PR, it can't be migrated", "pr", pr.BitbucketID, "branch", pr.Head, "commit", pr.SourceCommit)
+			continue
+		}
+		branch := prBranch(pr.BitbucketID)
+		slog.Info("Recreating PR head", "pr", pr.BitbucketID, "branch", branch, "commit", commit)
+		refspecs = append(refspecs, commit+":refs/heads/"+branch)
+		pr.Head = branch
+	}
+	if len(refspecs) == 0 || config.dryRun {
+		return
+	}
+	remoteURL, env := target.gitRemote(repoName)
+	// the branches are btg's own, so they are overwritten when a migration is repeated
+	output, err := runGitLoggedEnv(repoFolder, env, append([]string{"push", "--force", remoteURL}, refspecs...)...)
+	if err != nil {
+		fatalf("Failed to push PR heads: %s\nOutput: %s", err, output)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// summary of a run, written as JSON, CSV and HTML after every repo
+type migrationReport struct {
+	StartedAt  time.Time     `json:"startedAt"`
+	FinishedAt time.Time     `json:"finishedAt"`
+	Repos      []*repoReport `json:"repos"`
+
+	dir     string
+	current *repoReport
+}
+
+type repoReport struct {
+	Repo            string        `json:"repo"`
+	GithubURL       string        `json:"githubUrl"`
+	Status          string        `json:"status"`
+	Phases          []phaseReport `json:"phases"`
+	RefsPushed      int           `json:"refsPushed"`
+	SizeBytes       int64         `json:"sizeBytes"`
+	OpenPrsMigrated int           `json:"openPrsMigrated"`
+	IssuesCreated   int           `json:"issuesCreated"`
+	ElapsedSeconds  float64       `json:"elapsedSeconds"`
+	Warnings        []string      `json:"warnings"`
+	Errors          []string      `json:"errors"`
+
+	startedAt time.Time
+}
+
+type phaseReport struct {
+	Name           string  `json:"name"`
+	ElapsedSeconds float64 `json:"elapsedSeconds"`
+}
+
+// the report of the current run, nil when the command doesn't write a report
+var report *migrationReport
+
+func newReport(dir string) *migrationReport {
+	return &migrationReport{
+		StartedAt: time.Now(),
+		Repos:     []*repoReport{},
+		dir:       dir,
+	}
+}
+
+func (r *migrationReport) startRepo(repoName string) {
+	if r == nil {
+		return
+	}
+	r.current = &repoReport{
+		Repo:      repoName,
+		Status:    "in progress",
+		Phases:    []phaseReport{},
+		Warnings:  []string{},
+		Errors:    []string{},
+		startedAt: time.Now(),
+	}
+	r.Repos = append(r.Repos, r.current)
+}
+
+func (r *migrationReport) finishRepo() {
+	if r == nil || r.current == nil {
+		return
+	}
+	r.current.Status = "migrated"
+	r.current.ElapsedSeconds = time.Since(r.current.startedAt).Seconds()
+	r.current = nil
+	r.write()
+}
+
+// runs fn and records how long it took
+// every line logged by fn has a phase field
+func (r *migrationReport) phase(name string, fn func()) {
+	stopLog := startPhaseLog(name)
+	defer stopLog()
+	start := time.Now()
+	fn()
+	if r == nil || r.current == nil {
+		return
+	}
+	r.current.Phases = append(r.current.Phases, phaseReport{Name: name, ElapsedSeconds: time.Since(start).Seconds()})
+}
+
+// updates the report of the repo being migrated
+func (r *migrationReport) update(fn func(repo *repoReport)) {
+	if r == nil || r.current == nil {
+		return
+	}
+	fn(r.current)
+}
+
+// logs a warning and adds it to the report.
+// args are key value pairs like in slog.Warn
+func warn(msg string, args ...any) {
+	slog.Warn(msg, args...)
+	message := msg
+	for i := 0; i+1 < len(args); i += 2 {
+		message += fmt.Sprintf(" %v=%v", args[i], args[i+1])
+	}
+	report.update(func(repo *repoReport) {
+		repo.Warnings = append(repo.Warnings, message)
+	})
+}
+
+// records the error in the report, writes the report and exits
+func fatalf(format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	report.update(func(repo *repoReport) {
+		repo.Status = "failed"
+		repo.Errors = append(repo.Errors, message)
+		repo.ElapsedSeconds = time.Since(repo.startedAt).Seconds()
+	})
+	report.write()
+	slog.Error(message)
+	os.Exit(1)
+}
+
+func (r *migrationReport) write() {
+	if r == nil {
+		return
+	}
+	r.FinishedAt = time.Now()
+	err := os.MkdirAll(r.dir, 0o755)
+	if err != nil {
+		slog.Error("Failed to create report directory", "dir", r.dir, "err", err)
+		os.Exit(1)
+	}
+	base := filepath.Join(r.dir, "btg-report-"+r.StartedAt.Format("20060102-150405"))
+	for _, writer := range []struct {
+		ext   string
+		write func(file *os.File) error
+	}{
+		{".json", r.writeJSON},
+		{".csv", r.writeCSV},
+		{".html", r.writeHTML},
+	} {
+		file, err := os.Create(base + writer.ext)
+		if err != nil {
+			slog.Error("Failed to create report", "file", base+writer.ext, "err", err)
+			os.Exit(1)
+		}
+		err = writer.write(file)
+		file.Close()
+		if err != nil {
+			slog.Error("Failed to write report", "file", base+writer.ext, "err", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func (r *migrationReport) writeJSON(file *os.File) error {
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+func (r *migrationReport) writeCSV(file *os.File) error {
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"repo", "github url", "status", "phases", "refs pushed", "size bytes",
+		"open prs migrated", "issues created", "elapsed seconds", "warnings", "errors"})
+	for _, repo := range r.Repos {
+		phases := []string{}
+		for _, phase := range repo.Phases {
+			phases = append(phases, fmt.Sprintf("%s (%.1fs)", phase.Name, phase.ElapsedSeconds))
+		}
+		writer.Write([]string{
+			repo.Repo,
+			repo.GithubURL,
+			repo.Status,
+			strings.Join(phases, "; "),
+			strconv.Itoa(repo.RefsPushed),
+			strconv.FormatInt(repo.SizeBytes, 10),
+			strconv.Itoa(repo.OpenPrsMigrated),
+			strconv.Itoa(repo.IssuesCreated),
+			strconv.FormatFloat(repo.ElapsedSeconds, 'f', 1, 64),
+			strings.Join(repo.Warnings, "; "),
+			strings.Join(repo.Errors, "; "),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Bitbucket to Github migration report</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+.failed { background: #fdd; }
+.migrated { background: #dfd; }
+</style>
+</head>
+<body>
+<h1>Bitbucket to Github migration report</h1>
+<p>Started {{.StartedAt.Format "2006-01-02 15:04:05"}}, last updated {{.FinishedAt.Format "2006-01-02 15:04:05"}}</p>
+<table>
+<tr><th>Repo</th><th>Status</th><th>Phases</th><th>Refs pushed</th><th>Size (bytes)</th><th>Open PRs</th><th>Issues</th><th>Elapsed (s)</th><th>Warnings</th><th>Errors</th></tr>
+{{range .Repos}}<tr class="{{.Status}}">
+<td>{{if .GithubURL}}<a href="{{.GithubURL}}">{{.Repo}}</a>{{else}}{{.Repo}}{{end}}</td>
+<td>{{.Status}}</td>
+<td>{{range .Phases}}{{.Name}} ({{printf "%.1f" .ElapsedSeconds}}s)<br>{{end}}</td>
+<td>{{.RefsPushed}}</td>
+<td>{{.SizeBytes}}</td>
+<td>{{.OpenPrsMigrated}}</td>
+<td>{{.IssuesCreated}}</td>
+<td>{{printf "%.1f" .ElapsedSeconds}}</td>
+<td>{{range .Warnings}}{{.}}<br>{{end}}</td>
+<td>{{range .Errors}}{{.}}<br>{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func (r *migrationReport) writeHTML(file *os.File) error {
+	return reportTemplate.Execute(file, r)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReportWrite(t *testing.T) {
+	dir := t.TempDir()
+	r := newReport(dir)
+	r.startRepo("repo1")
+	r.phase("push", func() {})
+	r.update(func(repo *repoReport) {
+		repo.GithubURL = "https://github.com/org/repo1"
+		repo.RefsPushed = 3
+		repo.Warnings = append(repo.Warnings, "branch, deleted")
+	})
+	r.finishRepo()
+
+	for _, ext := range []string{".json", ".html"} {
+		matches, _ := filepath.Glob(filepath.Join(dir, "btg-report-*"+ext))
+		if len(matches) != 1 {
+			t.Errorf("expected one %s report, found %v", ext, matches)
+		}
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "btg-report-*.csv"))
+	if len(matches) != 1 {
+		t.Fatalf("expected one csv report, found %v", matches)
+	}
+	file, err := os.Open(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("expected header and one row, got %d rows", len(rows))
+	}
+	row := rows[1]
+	if row[0] != "repo1" || row[2] != "migrated" || row[4] != "3" || row[9] != "branch, deleted" {
+		t.Errorf("unexpected row %v", row)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/google/go-github/v72/github"
+)
+
+const deleteIssueMutation = `mutation($issueId: ID!) { deleteIssue(input: {issueId: $issueId}) { clientMutationId } }`
+
+// undoes a migration of repoName using its journal, mode decides what happens to a Github repo btg created:
+// delete it, archive it or keep it and only remove what btg added to it.
+// Returns what could not be undone
+func rollbackRepo(target *githubTarget, bb *bitbucketClient, repoName string, mode string, config settings) []string {
+	failures := []string{}
+	j := readJournal(repoName, config)
+	if j == nil {
+		slog.Info("No journal, nothing to undo on Github", "repo", repoName)
+	} else {
+		failures = rollbackGithub(target.gh, j, mode, config)
+	}
+
+	// these exit on failure and keep their state, so rollback can be run again
+	restorePermissions(bb, repoName, config)
+	unfreezeRepo(bb, repoName, config)
+	unmarkMoved(bb, repoName, config)
+	return failures
+}
+
+func rollbackGithub(gh *githubClient, j *migrationJournal, mode string, config settings) []string {
+	failures := []string{}
+	fail := func(format string, args ...any) {
+		message := fmt.Sprintf(format, args...)
+		slog.Error(message, "repo", j.Repo)
+		failures = append(failures, message)
+	}
+	if config.dryRun {
+		slog.Info("Mock rolling back Github repo", "repo", j.Repo, "mode", mode, "created", j.RepoCreated,
+			"prs", len(j.PullRequests), "issues", len(j.Issues), "comments", len(j.Comments))
+		return failures
+	}
+	ctx := context.Background()
+
+	if j.RepoCreated && mode == "delete" {
+		slog.Info("Deleting Github repo", "github_repo", j.Owner+"/"+j.Repo)
+		_, err := gh.Repositories.Delete(ctx, j.Owner, j.Repo)
+		if err != nil {
+			fail("Failed to delete Github repo %s/%s: %s", j.Owner, j.Repo, err)
+			return failures
+		}
+		removeState(config, j.Repo, "journal")
+		return failures
+	}
+	if j.RepoCreated && mode == "archive" {
+		slog.Info("Archiving Github repo", "github_repo", j.Owner+"/"+j.Repo)
+		_, _, err := gh.Repositories.Edit(ctx, j.Owner, j.Repo, &github.Repository{Archived: github.Ptr(true)})
+		if err != nil {
+			fail("Failed to archive Github repo %s/%s: %s", j.Owner, j.Repo, err)
+			return failures
+		}
+		removeState(config, j.Repo, "journal")
+		return failures
+	}
+	if !j.RepoCreated {
+		fail("Github repo %s/%s existed before the migration, the refs pushed to it can't be undone", j.Owner, j.Repo)
+	}
+
+	// the journal is updated as things are removed so running rollback again only retries what failed
+	for _, id := range slices.Clone(j.Comments) {
+		_, err := gh.Repositories.DeleteComment(ctx, j.Owner, j.Repo, id)
+		if err != nil {
+			fail("Failed to delete commit comment %d: %s", id, err)
+			continue
+		}
+		j.record(func(j *migrationJournal) {
+			j.Comments = slices.DeleteFunc(j.Comments, func(c int64) bool { return c == id })
+		})
+	}
+	for _, issue := range slices.Clone(j.Issues) {
+		// only GraphQL can delete issues, and only for repo admins
+		err := gh.GraphQL.Query(ctx, deleteIssueMutation, map[string]any{"issueId": issue.NodeID}, nil)
+		if err != nil {
+			fail("Failed to delete issue #%d: %s", issue.Number, err)
+			continue
+		}
+		j.record(func(j *migrationJournal) {
+			j.Issues = slices.DeleteFunc(j.Issues, func(i journalIssue) bool { return i == issue })
+		})
+	}
+	for _, number := range slices.Clone(j.PullRequests) {
+		// Github can't delete PRs, closing them is as close as it gets
+		_, _, err := gh.PullRequests.Edit(ctx, j.Owner, j.Repo, number, &github.PullRequest{State: github.Ptr("closed")})
+		if err != nil {
+			fail("Failed to close PR #%d: %s", number, err)
+			continue
+		}
+		j.record(func(j *migrationJournal) {
+			j.PullRequests = slices.DeleteFunc(j.PullRequests, func(n int) bool { return n == number })
+		})
+	}
+	if len(j.Comments) == 0 && len(j.Issues) == 0 && len(j.PullRequests) == 0 {
+		removeState(config, j.Repo, "journal")
+	}
+	return failures
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRollbackKeep(t *testing.T) {
+	bb := newFakeBitbucket(t)
+	gh := newFakeGithub(t)
+	config := fakeSettings(t, bb, gh)
+	config.bbFreeze = true
+	config.bbMarkMoved = true
+	mergeCommit := seedBitbucketRepo(t, bb, config.bbWorkspace, "repo1")
+	migrateRepo(gh.target(config), bb.client(), "repo1", config)
+
+	failures := rollbackRepo(gh.target(config), bb.client(), "repo1", "keep", config)
+	if len(failures) != 0 {
+		t.Errorf("unexpected failures %v", failures)
+	}
+
+	repo := gh.repo("org", "repo1")
+	if repo == nil {
+		t.Fatal("expected the github repo to be kept")
+	}
+	if len(repo.issues) != 0 || len(repo.comments[mergeCommit]) != 0 {
+		t.Errorf("expected issues and comments to be removed, got %d issues and comments %v", len(repo.issues), repo.comments[mergeCommit])
+	}
+	for _, pull := range repo.pulls {
+		if pull.GetState() != "closed" {
+			t.Errorf("expected PR #%d to be closed", pull.GetNumber())
+		}
+	}
+	if got := bb.permission(config.bbWorkspace, "repo1", "user", "account-1"); got != "write" {
+		t.Errorf("expected write permission to be restored, got %s", got)
+	}
+	if len(bb.restrictions["workspace/repo1"]) != 0 {
+		t.Errorf("expected the freeze to be lifted, got %v", bb.restrictions["workspace/repo1"])
+	}
+	if bb.repos["workspace/repo1"]["description"] != "the repo1 repo" {
+		t.Errorf("expected the description to be restored, got %q", bb.repos["workspace/repo1"]["description"])
+	}
+	for _, kind := range []string{"journal", "permissions", "freeze", "moved"} {
+		if readState(config, "repo1", kind, &struct{}{}) {
+			t.Errorf("expected the %s state to be removed", kind)
+		}
+	}
+}
+
+func TestRollbackDelete(t *testing.T) {
+	bb := newFakeBitbucket(t)
+	gh := newFakeGithub(t)
+	config := fakeSettings(t, bb, gh)
+	seedBitbucketRepo(t, bb, config.bbWorkspace, "repo1")
+	migrateRepo(gh.target(config), bb.client(), "repo1", config)
+
+	failures := rollbackRepo(gh.target(config), bb.client(), "repo1", "delete", config)
+	if len(failures) != 0 {
+		t.Errorf("unexpected failures %v", failures)
+	}
+	if gh.repo("org", "repo1") != nil {
+		t.Error("expected the github repo to be deleted")
+	}
+
+	// a repo that existed before the migration is never deleted
+	config.overwrite = true
+	migrateRepo(gh.target(config), bb.client(), "repo1", config)
+	readJournal("repo1", config).record(func(j *migrationJournal) { j.RepoCreated = false })
+	failures = rollbackRepo(gh.target(config), bb.client(), "repo1", "delete", config)
+	if len(failures) != 1 || gh.repo("org", "repo1") == nil {
+		t.Errorf("expected the repo to be kept and the pushed refs to be reported, got %v", failures)
+	}
+}
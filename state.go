@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// btg keeps what it needs to undo its changes to bitbucket in STATE_DIR,
+// in one file per repo and kind of change
+func statePath(config settings, repoName string, kind string) string {
+	return filepath.Join(config.stateDir, fmt.Sprintf("%s-%s.json", repoName, kind))
+}
+
+// decodes the state into v, returns false if there is none
+func readState(config settings, repoName string, kind string, v any) bool {
+	path := statePath(config, repoName, kind)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	if err != nil {
+		fatalf("Failed to read %s: %s", path, err)
+	}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		fatalf("Failed to parse %s: %s", path, err)
+	}
+	return true
+}
+
+func writeState(config settings, repoName string, kind string, v any) {
+	path := statePath(config, repoName, kind)
+	err := os.MkdirAll(config.stateDir, 0o755)
+	if err != nil {
+		fatalf("Failed to create state directory %s: %s", config.stateDir, err)
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fatalf("Failed to encode %s: %s", path, err)
+	}
+	err = os.WriteFile(path, data, 0o644)
+	if err != nil {
+		fatalf("Failed to write %s: %s", path, err)
+	}
+}
+
+func removeState(config settings, repoName string, kind string) {
+	path := statePath(config, repoName, kind)
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fatalf("Failed to remove %s: %s", path, err)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// what the last migration or sync brought over, so sync only brings over what changed since
+type syncState struct {
+	SyncedAt time.Time `json:"syncedAt"`
+	// branch and tag refs on the target as btg left them
+	Refs map[string]string `json:"refs"`
+	// bitbucket ids of the PRs created on the target
+	OpenPrs []int `json:"openPrs"`
+	// the number of each PR in OpenPrs on the target, by bitbucket id
+	PrNumbers map[int]int `json:"prNumbers"`
+	// bitbucket ids of the PRs recorded as historical issues
+	MergedPrs []int `json:"mergedPrs"`
+}
+
+// adds what a migration or sync brought over to the sync state, refs are left as they were when nil.
+// createdPrs are the PRs created on the target by bitbucket id, closedPrs the ones closed again
+func recordSync(repoName string, refs map[string]string, createdPrs map[int]int, closedPrs []int, issues []plannedIssue, config settings) {
+	if config.dryRun {
+		return
+	}
+	state := syncState{Refs: map[string]string{}, OpenPrs: []int{}, PrNumbers: map[int]int{}, MergedPrs: []int{}}
+	readState(config, repoName, "sync", &state)
+	state.SyncedAt = time.Now()
+	if refs != nil {
+		state.Refs = refs
+	}
+	if state.PrNumbers == nil {
+		// sync states written before numbers were recorded
+		state.PrNumbers = map[int]int{}
+	}
+	for _, id := range slices.Sorted(maps.Keys(createdPrs)) {
+		state.OpenPrs = append(state.OpenPrs, id)
+		state.PrNumbers[id] = createdPrs[id]
+	}
+	for _, id := range closedPrs {
+		state.OpenPrs = slices.DeleteFunc(state.OpenPrs, func(open int) bool { return open == id })
+		delete(state.PrNumbers, id)
+	}
+	for _, issue := range issues {
+		state.MergedPrs = append(state.MergedPrs, issue.BitbucketID)
+	}
+	writeState(config, repoName, "sync", state)
+}
+
+// lists the refs of the migrated repo on the target, nil on dry runs as there is nothing to list
+func targetRefs(target migrationTarget, repoName string, config settings) map[string]string {
+	if config.dryRun {
+		return nil
+	}
+	refs, err := listRemoteRefs(target.gitRemote(repoName))
+	if err != nil {
+		fatalf("Failed to list refs on %s: %s", target.name(), err)
+	}
+	return refs
+}
+
+// a change sync makes to a ref on the target
+type refUpdate struct {
+	Ref   string
+	From  string // empty for new refs
+	To    string // empty for deleted refs
+	Force bool   // not a fast forward, so only pushed while the ref is still at From on the target
+}
+
+// decides which refs of the bitbucket mirror can be pushed to the target.
+// New refs and fast forwards are pushed, refs rewritten or deleted on bitbucket only
+// when they haven't changed on the target since the last sync. Everything else has diverged
+func planRefUpdates(mirror string, local map[string]string, remote map[string]string, synced map[string]string) ([]refUpdate, []string) {
+	updates := []refUpdate{}
+	diverged := []string{}
+	for _, ref := range slices.Sorted(maps.Keys(local)) {
+		to, from := local[ref], remote[ref]
+		switch {
+		case from == to:
+		case from == "":
+			updates = append(updates, refUpdate{Ref: ref, To: to})
+		case isAncestor(mirror, from, to):
+			updates = append(updates, refUpdate{Ref: ref, From: from, To: to})
+		case from == synced[ref]:
+			// force pushed on bitbucket, e.g. after a rebase
+			updates = append(updates, refUpdate{Ref: ref, From: from, To: to, Force: true})
+		default:
+			diverged = append(diverged, ref)
+		}
+	}
+	for _, ref := range slices.Sorted(maps.Keys(remote)) {
+		if _, ok := local[ref]; ok {
+			continue
+		}
+		if strings.HasPrefix(ref, "refs/heads/"+prBranchPrefix) {
+			// the heads of migrated PRs, deleting them would close the PRs
+			continue
+		}
+		if remote[ref] == synced[ref] {
+			updates = append(updates, refUpdate{Ref: ref, From: remote[ref]})
+		} else if synced[ref] != "" {
+			diverged = append(diverged, ref)
+		}
+		// refs that were never synced were created on the target, they are left alone
+	}
+	return updates, diverged
+}
+
+// pushes the changes of the mirror to the target and returns the refs of the target afterwards
+func pushRefUpdates(mirror string, repoName string, target migrationTarget, synced map[string]string, config settings) map[string]string {
+	remoteURL, env := target.gitRemote(repoName)
+	local, err := listLocalRefs(mirror)
+	if err != nil {
+		fatalf("Failed to list refs of the mirror: %s", err)
+	}
+	remote, err := listRemoteRefs(remoteURL, env)
+	if err != nil {
+		fatalf("Failed to list refs on %s: %s", target.name(), err)
+	}
+	updates, diverged := planRefUpdates(mirror, local, remote, synced)
+	for _, ref := range diverged {
+		warn("Ref has diverged between Bitbucket and "+target.name()+", leaving it as it is", "ref", ref, "bitbucket", local[ref], "target", remote[ref])
+	}
+	if len(updates) == 0 {
+		slog.Info("Nothing to push")
+		return remote
+	}
+
+	if config.migrateLfs {
+		lfsObjects, err := findLfsObjects(mirror)
+		if err != nil {
+			fatalf("Failed to scan repo for LFS pointers: %s", err)
+		}
+		if len(lfsObjects) > 0 && !config.dryRun {
+			missing := fetchLfsObjects(mirror, lfsObjects, bitbucketGitEnv(config))
+			if len(missing) > 0 {
+				warn("LFS objects are missing on bitbucket and can't be migrated", "lfs_objects", missing)
+			}
+			pushLfsObjects(mirror, remoteURL, env)
+		}
+	}
+
+	args := []string{"push", remoteURL}
+	for _, update := range updates {
+		slog.Info("Updating ref", "ref", update.Ref, "from", update.From, "to", update.To)
+		if update.To == "" || update.Force {
+			// fails if the ref changed on the target after it was listed
+			args = append(args, fmt.Sprintf("--force-with-lease=%s:%s", update.Ref, update.From))
+		}
+		args = append(args, update.To+":"+update.Ref)
+	}
+	if config.dryRun {
+		return remote
+	}
+	output, err := runGitLoggedEnv(mirror, env, args...)
+	if err != nil {
+		fatalf("Failed to push: %s\nOutput: %s", err, output)
+	}
+	report.update(func(repo *repoReport) { repo.RefsPushed = len(updates) })
+	return targetRefs(target, repoName, config)
+}
+
+func syncRepos(target migrationTarget, bb *bitbucketClient, repos []string, config settings) {
+	if config.dryRun {
+		slog.Info("Dry Run - not actually syncing anything")
+	}
+	for _, repo := range repos {
+		syncRepo(target, bb, repo, config)
+	}
+}
+
+// brings what changed on bitbucket since the last migration or sync over to the target
+func syncRepo(target migrationTarget, bb *bitbucketClient, repoName string, config settings) {
+	stopLog := startRepoLog(repoName, config)
+	defer stopLog()
+	report.startRepo(repoName)
+	stopJournal := startJournal(repoName, config)
+	defer stopJournal()
+
+	var state syncState
+	if !readState(config, repoName, "sync", &state) {
+		fatalf("%s has no sync state, migrate it with migrate or apply before syncing", repoName)
+	}
+	slog.Info("Syncing to "+target.name(), "last_sync", state.SyncedAt)
+	report.update(func(repo *repoReport) {
+		repo.GithubURL = strings.TrimSuffix(target.repoURL(repoName), ".git")
+	})
+	bbRepo := getRepo(bb, config.bbWorkspace, repoName)
+	ghRepo := newGithubRepo(bbRepo, config)
+
+	var prs *PullRequests
+	if config.migrateOpenPrs || config.migrateClosedPrs {
+		report.phase("get PRs", func() {
+			// declined PRs too, to close the ones migrated while they were open
+			prs = getPrsInStates(bb, config.bbWorkspace, repoName, bbRepo.Mainbranch.Name, "MERGED", "OPEN", "DECLINED")
+		})
+	}
+
+	var refs map[string]string
+	var mirror string
+	if config.migrateRepoContents {
+		// the branches of every open PR from a fork, so updates to PRs synced before are brought over too
+		var forkPrs []plannedPullRequest
+		if config.migrateOpenPrs {
+			forkPrs = renderOpenPrs(prs, ghRepo.GetDefaultBranch())
+		}
+		report.phase("fetch", func() {
+			mirror = updateMirror(repoName, forkPrs, config)
+		})
+		report.phase("push", func() {
+			refs = pushRefUpdates(mirror, repoName, target, state.Refs, config)
+		})
+	}
+	var createdPrs map[int]int
+	if config.migrateOpenPrs {
+		newPrs := &PullRequests{}
+		for _, pr := range prs.Values {
+			if pr.State == "OPEN" && !slices.Contains(state.OpenPrs, pr.ID) {
+				newPrs.Values = append(newPrs.Values, pr)
+			}
+		}
+		report.phase("open PRs", func() {
+			openPrs := renderOpenPrs(newPrs, ghRepo.GetDefaultBranch())
+			if mirror != "" {
+				pushPrHeads(mirror, repoName, target, openPrs, config)
+			}
+			createdPrs = target.createPullRequests(ghRepo, openPrs)
+		})
+	}
+	// PRs migrated while they were open that have been merged or declined since, their PRs on the target are closed
+	var closedPrs []int
+	if prs != nil {
+		for _, pr := range prs.Values {
+			if pr.State != "OPEN" && slices.Contains(state.OpenPrs, pr.ID) {
+				closedPrs = append(closedPrs, pr.ID)
+			}
+		}
+	}
+	if len(closedPrs) > 0 {
+		report.phase("close PRs", func() {
+			for _, id := range closedPrs {
+				number, ok := state.PrNumbers[id]
+				if !ok {
+					warn("PR was closed on bitbucket, but its number on the target isn't known to close it", "pr", id)
+					continue
+				}
+				slog.Info("PR was closed on bitbucket, closing it", "pr", id)
+				target.closePullRequest(ghRepo, number)
+			}
+		})
+	}
+	var issues []plannedIssue
+	if config.migrateClosedPrs {
+		newPrs := &PullRequests{}
+		for _, pr := range prs.Values {
+			if pr.State == "MERGED" && !slices.Contains(state.MergedPrs, pr.ID) {
+				newPrs.Values = append(newPrs.Values, pr)
+			}
+		}
+		report.phase("closed PRs", func() {
+			issues = renderClosedPrs(newPrs)
+			target.createHistoricalRecords(ghRepo, issues)
+		})
+	}
+	recordSync(repoName, refs, createdPrs, closedPrs, issues, config)
+	report.finishRepo()
+	slog.Info("done syncing repo")
+
+	time.Sleep(GitHubRateLimitSleep)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+// commits a file on branch of the git repo at remote and pushes it back
+func commitTo(t *testing.T, remote string, branch string, file string) string {
+	work := filepath.Join(t.TempDir(), "work")
+	testGit(t, "", "clone", "-b", branch, remote, work)
+	os.WriteFile(filepath.Join(work, file), []byte(file), 0o644)
+	testGit(t, work, "add", ".")
+	testGit(t, work, "commit", "-m", "add "+file)
+	testGit(t, work, "push", "origin", branch)
+	return testGit(t, work, "rev-parse", "HEAD")
+}
+
+func TestSyncRepo(t *testing.T) {
+	bb := newFakeBitbucket(t)
+	gh := newFakeGithub(t)
+	config := fakeSettings(t, bb, gh)
+	config.revokeOldPerms = false
+	seedBitbucketRepo(t, bb, config.bbWorkspace, "repo1")
+	bare := filepath.Join(bb.gitDir, config.bbWorkspace, "repo1.git")
+	testGit(t, bare, "branch", "rebased", "feature")
+	migrateRepo(gh.target(config), bb.client(), "repo1", config)
+
+	ghBare := gh.gitRepoDir(gh.repo("org", "repo1"))
+	// rewritten on bitbucket only, so it is force pushed
+	done := testGit(t, bare, "rev-parse", "done")
+	testGit(t, bare, "branch", "-f", "rebased", done)
+	feature := commitTo(t, bare, "feature", "more.txt")
+	testGit(t, bare, "branch", "next", feature)
+	testGit(t, bare, "branch", "-D", "done")
+	bb.addPr(config.bbWorkspace, "repo1", 3, "OPEN", "Next feature", "next", "")
+	// skipped until its branch exists
+	bb.addPr(config.bbWorkspace, "repo1", 4, "OPEN", "Missing branch", "missing", "")
+	bb.mergePr(config.bbWorkspace, "repo1", 2, feature)
+	// main changes on both sides, so it can't be synced
+	commitTo(t, bare, "main", "bitbucket.txt")
+	main := commitTo(t, ghBare, "main", "github.txt")
+
+	syncRepo(gh.target(config), bb.client(), "repo1", config)
+
+	refs, err := listLocalRefs(ghBare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ref, want := range map[string]string{
+		"refs/heads/feature": feature,
+		"refs/heads/next":    feature,
+		"refs/heads/done":    "",
+		"refs/heads/rebased": done,
+		"refs/heads/main":    main,
+	} {
+		if refs[ref] != want {
+			t.Errorf("expected %s to be %q on github, got %q", ref, want, refs[ref])
+		}
+	}
+
+	repo := gh.repo("org", "repo1")
+	if len(repo.pulls) != 2 || repo.pulls[1].GetHead().GetRef() != "next" {
+		t.Errorf("expected only the new PR to be created, got %v", repo.pulls)
+	}
+	if repo.pulls[0].GetState() != "closed" {
+		t.Error("expected the PR merged on bitbucket to be closed")
+	}
+	if len(repo.issues) != 2 {
+		t.Errorf("expected only the newly merged PR to be recorded, got %d issues", len(repo.issues))
+	}
+
+	var state syncState
+	readState(config, "repo1", "sync", &state)
+	if diff := deep.Equal(state.OpenPrs, []int{3}); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(state.Refs, refs); diff != nil {
+		t.Error(diff)
+	}
+
+	// the skipped PR is created once its branch exists, and declined PRs are closed
+	testGit(t, bare, "branch", "missing", feature)
+	bb.declinePr(config.bbWorkspace, "repo1", 3)
+	syncRepo(gh.target(config), bb.client(), "repo1", config)
+	if len(repo.pulls) != 3 || repo.pulls[2].GetHead().GetRef() != "missing" {
+		t.Errorf("expected the skipped PR to be created, got %v", repo.pulls)
+	}
+	if repo.pulls[1].GetState() != "closed" {
+		t.Error("expected the PR declined on bitbucket to be closed")
+	}
+	readState(config, "repo1", "sync", &state)
+	if diff := deep.Equal(state.OpenPrs, []int{4}); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/google/go-github/v72/github"
+)
+
+// where repos are migrated to, selected with TARGET.
+// Repos are described with the Github types, every target maps them to its own API
+type migrationTarget interface {
+	name() string
+	// creates the repo, refusing to overwrite an existing one unless configured to
+	createRepo(repo *github.Repository) *github.Repository
+	// the https url of the repo, used for LFS and reports
+	repoURL(repoName string) string
+	// the url git pushes to and the environment that gives git access to it
+	gitRemote(repoName string) (remoteURL string, env []string)
+	// basic auth credentials for the Git LFS batch API
+	lfsCredentials() (username string, password string)
+	// sets default branch and topics, plus custom properties where the target has them
+	updateSettings(repo *github.Repository, customProps []*github.CustomPropertyValue)
+	// creates a PR (or merge request) for every open bitbucket PR.
+	// Returns the number of each PR it created by bitbucket id, PRs it skipped aren't in it
+	createPullRequests(repo *github.Repository, prs []plannedPullRequest) map[int]int
+	// closes a PR (or merge request) created by createPullRequests
+	closePullRequest(repo *github.Repository, number int)
+	// records every merged bitbucket PR as a closed issue linked from its merge commit
+	createHistoricalRecords(repo *github.Repository, issues []plannedIssue)
+}
+
+type githubTarget struct {
+	gh     *githubClient
+	config settings
+	tokens githubTokenSource
+}
+
+func (t *githubTarget) name() string {
+	return "Github"
+}
+
+func (t *githubTarget) createRepo(repo *github.Repository) *github.Repository {
+	return createRepo(t.gh, repo, t.config)
+}
+
+func (t *githubTarget) repoURL(repoName string) string {
+	return githubRepoURL(repoName, t.config)
+}
+
+func (t *githubTarget) lfsCredentials() (string, string) {
+	token, err := t.tokens.Token()
+	if err != nil {
+		fatalf("Failed to get Github token: %s", err)
+	}
+	return "x-access-token", token
+}
+
+func (t *githubTarget) gitRemote(repoName string) (string, []string) {
+	if t.config.ghPushVia == "ssh" {
+		return githubSSHURL(repoName, t.config), gitSSHKeyEnv(t.config.ghSSHKey)
+	}
+	username, password := t.lfsCredentials()
+	return githubRepoURL(repoName, t.config), gitCredentialEnv(username, password)
+}
+
+func (t *githubTarget) updateSettings(repo *github.Repository, customProps []*github.CustomPropertyValue) {
+	updateRepo(t.gh, t.config.ghOwner, repo, t.config.dryRun)
+	updateRepoTopics(t.gh, t.config.ghOwner, repo, t.config.dryRun)
+	updateCustomProperties(t.gh, t.config.ghOrg, repo, t.config.dryRun, customProps)
+}
+
+func (t *githubTarget) createPullRequests(repo *github.Repository, prs []plannedPullRequest) map[int]int {
+	return createOpenPrs(t.gh, t.config.ghOwner, repo, prs, t.config.dryRun)
+}
+
+func (t *githubTarget) closePullRequest(repo *github.Repository, number int) {
+	if t.config.dryRun {
+		slog.Info("Mock closing PR", "github_pr", number)
+		return
+	}
+	_, _, err := t.gh.PullRequests.Edit(context.Background(), t.config.ghOwner, repo.GetName(), number, &github.PullRequest{State: github.Ptr("closed")})
+	if err != nil {
+		fatalf("failed to close PR #%d: %s", number, err)
+	}
+	slog.Info("Closed PR", "github_pr", number)
+}
+
+func (t *githubTarget) createHistoricalRecords(repo *github.Repository, issues []plannedIssue) {
+	if t.config.ghClosedPrsAsPrs {
+		createClosedPrs(t.gh, t.config.ghOwner, repo, issues, t.config.ghIssueImport, t.config.dryRun)
+		return
+	}
+	createIssues(t.gh, t.config.ghOwner, repo, issues, t.config.ghIssueImport, t.config.dryRun)
+}
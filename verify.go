@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v72/github"
+)
+
+type verifyCheck struct {
+	Name   string
+	Passed bool
+	Detail string
+}
+
+type repoVerification struct {
+	Repo   string
+	Checks []verifyCheck
+}
+
+func (v *repoVerification) check(name string, passed bool, detail string) {
+	v.Checks = append(v.Checks, verifyCheck{Name: name, Passed: passed, Detail: detail})
+}
+
+func (v *repoVerification) passed() bool {
+	for _, check := range v.Checks {
+		if !check.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// compares every migrated repo against bitbucket.
+// Writes a pass/fail report to reportFile if it is not empty and returns whether all repos passed
+func verifyRepos(target *githubTarget, bb *bitbucketClient, repoList []string, config settings, reportFile string) bool {
+	results := []*repoVerification{}
+	for _, repo := range repoList {
+		results = append(results, verifyRepo(target, bb, repo, config))
+		time.Sleep(GitHubRateLimitSleep)
+	}
+
+	report := formatVerifyReport(results, config)
+	fmt.Print(report)
+	if reportFile != "" {
+		err := os.WriteFile(reportFile, []byte(report), 0o644)
+		if err != nil {
+			fatalf("Failed to write report to %s: %s", reportFile, err)
+		}
+		slog.Info("Report written", "file", reportFile)
+	}
+
+	return !slices.ContainsFunc(results, func(v *repoVerification) bool { return !v.passed() })
+}
+
+func verifyRepo(target *githubTarget, bb *bitbucketClient, repoName string, config settings) *repoVerification {
+	gh := target.gh
+	slog.Info("Verifying", "repo", repoName)
+	result := &repoVerification{Repo: repoName}
+	bbRepo := getRepo(bb, config.bbWorkspace, repoName)
+	expected := newGithubRepo(bbRepo, config)
+
+	ghRepo, _, err := gh.Repositories.Get(context.Background(), config.ghOwner, repoName)
+	if err != nil {
+		result.check("github repo exists", false, err.Error())
+		return result
+	}
+	result.check("github repo exists", true, ghRepo.GetHTMLURL())
+
+	if config.migrateRepoContents {
+		verifyRefs(target, result, repoName, config)
+	}
+
+	result.check("default branch", ghRepo.GetDefaultBranch() == expected.GetDefaultBranch(),
+		fmt.Sprintf("bitbucket %s, github %s", expected.GetDefaultBranch(), ghRepo.GetDefaultBranch()))
+	result.check("visibility", ghRepo.GetVisibility() == expected.GetVisibility(),
+		fmt.Sprintf("expected %s, github %s", expected.GetVisibility(), ghRepo.GetVisibility()))
+
+	if config.migrateRepoSettings {
+		missingTopics := []string{}
+		for _, topic := range expected.Topics {
+			// github stores topics in lowercase
+			if !slices.Contains(ghRepo.Topics, strings.ToLower(topic)) {
+				missingTopics = append(missingTopics, topic)
+			}
+		}
+		result.check("topics", len(missingTopics) == 0, fmt.Sprintf("github %v, missing %v", ghRepo.Topics, missingTopics))
+
+		if config.ghOrg != "" {
+			verifyCustomProperties(gh, result, repoName, newCustomProperties(bbRepo.Project.Name), config)
+		}
+	}
+
+	if config.migrateOpenPrs || config.migrateClosedPrs {
+		prs := getPrs(bb, config.bbWorkspace, repoName, bbRepo.Mainbranch.Name)
+		if config.migrateOpenPrs {
+			want := len(renderOpenPrs(prs, bbRepo.Mainbranch.Name))
+			got := countMigratedPrs(gh, config.ghOwner, repoName)
+			result.check("open PRs", got == want, fmt.Sprintf("bitbucket %d, github %d", want, got))
+		}
+		if config.migrateClosedPrs {
+			want := len(renderClosedPrs(prs))
+			got := countHistoricalIssues(gh, config.ghOwner, repoName)
+			result.check("historical PR issues", got == want, fmt.Sprintf("bitbucket %d, github %d", want, got))
+		}
+	}
+	return result
+}
+
+// checks every branch and tag on bitbucket points at the same SHA on github
+func verifyRefs(target *githubTarget, result *repoVerification, repoName string, config settings) {
+	bbRefs, err := listRemoteRefs(bitbucketCloneURL(repoName, config), bitbucketGitEnv(config))
+	if err != nil {
+		result.check("refs", false, fmt.Sprintf("could not list bitbucket refs: %s", err))
+		return
+	}
+	ghRefs, err := listRemoteRefs(target.gitRemote(repoName))
+	if err != nil {
+		result.check("refs", false, fmt.Sprintf("could not list github refs: %s", err))
+		return
+	}
+	problems := []string{}
+	for ref, sha := range bbRefs {
+		ghSha, ok := ghRefs[ref]
+		if !ok {
+			problems = append(problems, ref+" missing")
+		} else if ghSha != sha {
+			problems = append(problems, fmt.Sprintf("%s is %s on github but %s on bitbucket", ref, ghSha, sha))
+		}
+	}
+	slices.Sort(problems)
+	detail := fmt.Sprintf("%d bitbucket refs, %d github refs", len(bbRefs), len(ghRefs))
+	if len(problems) > 0 {
+		detail += ": " + strings.Join(problems, ", ")
+	}
+	result.check("refs", len(problems) == 0, detail)
+}
+
+func verifyCustomProperties(gh *githubClient, result *repoVerification, repoName string, expected []*github.CustomPropertyValue, config settings) {
+	actual, _, err := gh.Repositories.GetAllCustomPropertyValues(context.Background(), config.ghOrg, repoName)
+	if err != nil {
+		result.check("custom properties", false, err.Error())
+		return
+	}
+	problems := []string{}
+	for _, want := range expected {
+		i := slices.IndexFunc(actual, func(p *github.CustomPropertyValue) bool { return p.PropertyName == want.PropertyName })
+		if i == -1 {
+			problems = append(problems, want.PropertyName+" missing")
+		} else if actual[i].Value != want.Value {
+			problems = append(problems, fmt.Sprintf("%s is %v, expected %v", want.PropertyName, actual[i].Value, want.Value))
+		}
+	}
+	result.check("custom properties", len(problems) == 0, strings.Join(problems, ", "))
+}
+
+// counts github PRs created by createOpenPrs
+func countMigratedPrs(gh *githubClient, githubOwner string, repoName string) int {
+	count := 0
+	opts := &github.PullRequestListOptions{State: "all", ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		prs, resp, err := gh.PullRequests.List(context.Background(), githubOwner, repoName, opts)
+		if err != nil {
+			fatalf("failed to list PRs of %s: %s", repoName, err)
+		}
+		for _, pr := range prs {
+			// closed PRs recreated by createClosedPrs are labelled like historical issues
+			historical := slices.ContainsFunc(pr.Labels, func(l *github.Label) bool { return l.GetName() == "bitbucketPR" })
+			if strings.HasPrefix(pr.GetTitle(), "Historical Bitbucket PR #") && !historical {
+				count++
+			}
+		}
+		if resp.NextPage == 0 {
+			return count
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// counts github issues created by createIssues and closed PRs created by createClosedPrs
+func countHistoricalIssues(gh *githubClient, githubOwner string, repoName string) int {
+	count := 0
+	opts := &github.IssueListByRepoOptions{State: "all", Labels: []string{"bitbucketPR"}, ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		issues, resp, err := gh.Issues.ListByRepo(context.Background(), githubOwner, repoName, opts)
+		if err != nil {
+			fatalf("failed to list issues of %s: %s", repoName, err)
+		}
+		count += len(issues)
+		if resp.NextPage == 0 {
+			return count
+		}
+		opts.ListOptions.Page = resp.NextPage
+	}
+}
+
+func formatVerifyReport(results []*repoVerification, config settings) string {
+	var sb strings.Builder
+	failed := 0
+	fmt.Fprintf(&sb, "Migration verification %s -> %s at %s\n\n", config.bbWorkspace, config.ghOwner, time.Now().Format(time.RFC3339))
+	for _, result := range results {
+		status := "PASS"
+		if !result.passed() {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Fprintf(&sb, "%s %s\n", status, result.Repo)
+		for _, check := range result.Checks {
+			checkStatus := "ok  "
+			if !check.Passed {
+				checkStatus = "FAIL"
+			}
+			fmt.Fprintf(&sb, "  %s %s: %s\n", checkStatus, check.Name, check.Detail)
+		}
+	}
+	fmt.Fprintf(&sb, "\n%d of %d repos passed verification\n", len(results)-failed, len(results))
+	return sb.String()
+}
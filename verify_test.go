@@ -0,0 +1,75 @@
+package main
+
+import (
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/google/go-github/v72/github"
+)
+
+func TestVerifyRepo(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		closedPrsAsPrs bool
+		change         func(t *testing.T, bb *fakeBitbucket, gh *fakeGithub, config settings)
+		// the checks that fail and a part of their details
+		failed map[string]string
+	}{
+		{"migrated", false, nil, map[string]string{}},
+		{"closed PRs as PRs", true, nil, map[string]string{}},
+		{"missing ref", false, func(t *testing.T, bb *fakeBitbucket, gh *fakeGithub, config settings) {
+			testGit(t, gh.gitRepoDir(gh.repo("org", "repo1")), "branch", "-D", "done")
+		}, map[string]string{"refs": "refs/heads/done missing"}},
+		{"moved ref", false, func(t *testing.T, bb *fakeBitbucket, gh *fakeGithub, config settings) {
+			commitTo(t, gh.gitRepoDir(gh.repo("org", "repo1")), "main", "github.txt")
+		}, map[string]string{"refs": "refs/heads/main is "}},
+		{"missing PR", false, func(t *testing.T, bb *fakeBitbucket, gh *fakeGithub, config settings) {
+			bb.addPr(config.bbWorkspace, "repo1", 3, "OPEN", "Opened later", "done", "")
+		}, map[string]string{"open PRs": "bitbucket 2, github 1"}},
+		{"missing issue", false, func(t *testing.T, bb *fakeBitbucket, gh *fakeGithub, config settings) {
+			bare := filepath.Join(bb.gitDir, config.bbWorkspace, "repo1.git")
+			bb.addPr(config.bbWorkspace, "repo1", 3, "MERGED", "Merged later", "done", testGit(t, bare, "rev-parse", "main"))
+		}, map[string]string{"historical PR issues": "bitbucket 2, github 1"}},
+		{"unlabelled closed PR", true, func(t *testing.T, bb *fakeBitbucket, gh *fakeGithub, config settings) {
+			// counted as a migrated open PR instead of a historical one
+			repo := gh.repo("org", "repo1")
+			i := slices.IndexFunc(repo.pulls, func(pull *github.PullRequest) bool { return pull.GetState() == "closed" })
+			repo.pulls[i].Labels = nil
+		}, map[string]string{"open PRs": "bitbucket 1, github 2", "historical PR issues": "bitbucket 1, github 0"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bb := newFakeBitbucket(t)
+			gh := newFakeGithub(t)
+			config := fakeSettings(t, bb, gh)
+			config.ghClosedPrsAsPrs = tc.closedPrsAsPrs
+			seedBitbucketRepo(t, bb, config.bbWorkspace, "repo1")
+			migrateRepo(gh.target(config), bb.client(), "repo1", config)
+			if tc.change != nil {
+				tc.change(t, bb, gh, config)
+			}
+
+			result := verifyRepo(gh.target(config), bb.client(), "repo1", config)
+			failed := map[string]string{}
+			for _, check := range result.Checks {
+				if !check.Passed {
+					failed[check.Name] = check.Detail
+				}
+			}
+			if diff := deep.Equal(slices.Sorted(maps.Keys(failed)), slices.Sorted(maps.Keys(tc.failed))); diff != nil {
+				t.Fatalf("%v: %v", diff, failed)
+			}
+			for name, want := range tc.failed {
+				if !strings.Contains(failed[name], want) {
+					t.Errorf("expected the %s check to report %q, got %q", name, want, failed[name])
+				}
+			}
+			if result.passed() != (len(tc.failed) == 0) {
+				t.Errorf("expected the repo to pass only when no check fails")
+			}
+		})
+	}
+}